@@ -0,0 +1,187 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	FormatJson     = "json"
+	FormatCombined = "combined"
+)
+
+// Entry is a single line in the access log
+type Entry struct {
+	Time         time.Time
+	ClientIP     string
+	Method       string
+	URL          string
+	CanonicalURL string
+	Proto        string
+	Status       int
+	Bytes        int64
+	Duration     time.Duration
+	CacheResult  string
+	Rule         string
+	Rewriter     string
+	UpstreamHost string
+	Referer      string
+	UserAgent    string
+}
+
+// ClientIP returns the ip portion of a remote address
+func ClientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+
+	return remoteAddr
+}
+
+type Logger interface {
+	Log(e *Entry)
+}
+
+// Open returns a Logger that writes to a file in the given format, a path of
+// "-" or "stdout" writes to stdout and "stderr" to stderr
+func Open(path, format string) (Logger, error) {
+	var w io.Writer
+
+	switch path {
+	case "-", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	return New(w, format)
+}
+
+// New returns a Logger that writes to w in either json or combined format
+func New(w io.Writer, format string) (Logger, error) {
+	switch format {
+	case FormatJson:
+		return &writerLogger{w: w, format: formatJson}, nil
+	case FormatCombined:
+		return &writerLogger{w: w, format: formatCombined}, nil
+	}
+
+	return nil, fmt.Errorf("unknown access log format %q", format)
+}
+
+type writerLogger struct {
+	w      io.Writer
+	format func(e *Entry) []byte
+	mutex  sync.Mutex
+}
+
+func (l *writerLogger) Log(e *Entry) {
+	line := l.format(e)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.w.Write(line)
+}
+
+type jsonEntry struct {
+	Time         time.Time `json:"time"`
+	ClientIP     string    `json:"client_ip"`
+	Method       string    `json:"method"`
+	URL          string    `json:"url"`
+	CanonicalURL string    `json:"canonical_url,omitempty"`
+	Proto        string    `json:"proto"`
+	Status       int       `json:"status"`
+	Bytes        int64     `json:"bytes"`
+	DurationMs   float64   `json:"duration_ms"`
+	CacheResult  string    `json:"cache"`
+	Rule         string    `json:"rule,omitempty"`
+	Rewriter     string    `json:"rewriter,omitempty"`
+	UpstreamHost string    `json:"upstream_host,omitempty"`
+	Referer      string    `json:"referer,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+}
+
+func formatJson(e *Entry) []byte {
+	b, _ := json.Marshal(jsonEntry{
+		Time:         e.Time,
+		ClientIP:     e.ClientIP,
+		Method:       e.Method,
+		URL:          e.URL,
+		CanonicalURL: e.CanonicalURL,
+		Proto:        e.Proto,
+		Status:       e.Status,
+		Bytes:        e.Bytes,
+		DurationMs:   float64(e.Duration) / float64(time.Millisecond),
+		CacheResult:  e.CacheResult,
+		Rule:         e.Rule,
+		Rewriter:     e.Rewriter,
+		UpstreamHost: e.UpstreamHost,
+		Referer:      e.Referer,
+		UserAgent:    e.UserAgent,
+	})
+
+	return append(b, '\n')
+}
+
+// formatCombined writes the apache combined log format, followed by the
+// cache result, duration in ms, canonical url, rule, rewriter and upstream host
+func formatCombined(e *Entry) []byte {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	return []byte(fmt.Sprintf(
+		"%s - - [%s] \"%s %s %s\" %d %s %s %s %s %.3f %s %s %s %s\n",
+		e.ClientIP,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method,
+		e.URL,
+		e.Proto,
+		e.Status,
+		bytes,
+		quote(e.Referer),
+		quote(e.UserAgent),
+		quote(e.CacheResult),
+		float64(e.Duration)/float64(time.Millisecond),
+		quote(e.CanonicalURL),
+		quote(e.Rule),
+		quote(e.Rewriter),
+		quote(e.UpstreamHost),
+	))
+}
+
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+
+	return strconv.Quote(s)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying an entry, so that it can be
+// filled in further along the request
+func NewContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns the entry in a context, or nil
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(contextKey{}).(*Entry)
+	return e
+}
@@ -0,0 +1,63 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEntry = &Entry{
+	Time:         time.Date(2014, 6, 1, 10, 0, 0, 0, time.UTC),
+	ClientIP:     "10.0.0.1",
+	Method:       "GET",
+	URL:          "http://mirror.example.com/ubuntu/pool/main/a/a.deb",
+	CanonicalURL: "http://archive.ubuntu.com/ubuntu/pool/main/a/a.deb",
+	Proto:        "HTTP/1.1",
+	Status:       200,
+	Bytes:        1024,
+	Duration:     time.Millisecond * 1500,
+	CacheResult:  "HIT",
+	Rule:         `deb$`,
+	Rewriter:     "ubuntu",
+	UpstreamHost: "mirror.example.com",
+}
+
+func TestCombinedFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l, err := New(buf, FormatCombined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Log(testEntry)
+
+	expected := `10.0.0.1 - - [01/Jun/2014:10:00:00 +0000] "GET http://mirror.example.com/ubuntu/pool/main/a/a.deb HTTP/1.1" 200 1024 "-" "-" "HIT" 1500.000 "http://archive.ubuntu.com/ubuntu/pool/main/a/a.deb" "deb$" "ubuntu" "mirror.example.com"` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestJsonFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l, err := New(buf, FormatJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Log(testEntry)
+
+	if strings.Contains(buf.String(), "\x1b") {
+		t.Fatal("Expected no escape codes in json output")
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	if fields["cache"] != "HIT" || fields["bytes"] != float64(1024) || fields["duration_ms"] != float64(1500) {
+		t.Fatalf("Unexpected json fields %#v", fields)
+	}
+}
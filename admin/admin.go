@@ -0,0 +1,251 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/lox/package-proxy/cache"
+)
+
+// Handler serves an HTTP API for inspecting and purging the cache. It's
+// intended to be run on a separate listener from the proxy.
+//
+//	GET    /entries              list entries, optionally filtered with ?match=<regex>
+//	GET    /entries?url=<url>    show a single entry
+//	DELETE /entries?url=<url>    purge a single url
+//	DELETE /entries?match=<re>   purge all urls matching a regex
+//	DELETE /entries?pattern=<p>  purge all urls cached under a cache pattern
+//	GET    /patterns             list cache patterns
+//	POST   /expire               expire entries past their max age
+type Handler struct {
+	Cache    cache.Cache
+	Patterns cache.CachePatternSlice
+	mux      *http.ServeMux
+}
+
+func NewHandler(c cache.Cache, patterns cache.CachePatternSlice) *Handler {
+	h := &Handler{Cache: c, Patterns: patterns, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/entries", h.entries)
+	h.mux.HandleFunc("/patterns", h.patterns)
+	h.mux.HandleFunc("/expire", h.expire)
+	return h
+}
+
+// Handle registers an additional handler on the admin api
+func (h *Handler) Handle(pattern string, handler http.Handler) {
+	h.mux.Handle(pattern, handler)
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(rw, req)
+}
+
+type entryJson struct {
+	Key      string    `json:"key"`
+	URL      string    `json:"url"`
+	Size     int64     `json:"size"`
+	StoredAt time.Time `json:"stored_at"`
+	MaxAge   string    `json:"max_age"`
+	TTL      string    `json:"ttl"`
+	Hits     int64     `json:"hits"`
+	Pattern  string    `json:"pattern,omitempty"`
+}
+
+func (h *Handler) toJson(e cache.Entry) entryJson {
+	j := entryJson{
+		Key:      e.Key,
+		URL:      e.URL,
+		Size:     e.Size,
+		StoredAt: e.StoredAt,
+		MaxAge:   e.MaxAge.String(),
+		TTL:      e.TTL().String(),
+		Hits:     e.Hits,
+	}
+
+	if match, p := h.Patterns.MatchString(e.URL); match {
+		j.Pattern = p.String()
+	}
+
+	return j
+}
+
+func (h *Handler) entries(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+		if u := req.URL.Query().Get("url"); u != "" {
+			h.showEntry(rw, u)
+		} else {
+			h.listEntries(rw, req)
+		}
+	case "DELETE":
+		h.purgeEntries(rw, req)
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) showEntry(rw http.ResponseWriter, u string) {
+	e, err := h.Cache.Stat(cache.Key(u))
+	if err == cache.ErrNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(rw, h.toJson(e))
+}
+
+func (h *Handler) listEntries(rw http.ResponseWriter, req *http.Request) {
+	filter, err := h.filter(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries := []entryJson{}
+	h.Cache.Each(func(e cache.Entry) {
+		if filter(e) {
+			entries = append(entries, h.toJson(e))
+		}
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].URL < entries[j].URL
+	})
+
+	writeJson(rw, entries)
+}
+
+func (h *Handler) purgeEntries(rw http.ResponseWriter, req *http.Request) {
+	if u := req.URL.Query().Get("url"); u != "" {
+		if err := h.Cache.Delete(cache.Key(u)); err == cache.ErrNotFound {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("purged %s", u)
+		writeJson(rw, map[string]int{"purged": 1})
+		return
+	}
+
+	q := req.URL.Query()
+	if q.Get("match") == "" && q.Get("pattern") == "" {
+		http.Error(rw, "one of url, match or pattern is required", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := h.filter(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	purged := 0
+	h.Cache.Each(func(e cache.Entry) {
+		if filter(e) && h.Cache.Delete(e.Key) == nil {
+			log.Printf("purged %s", e.URL)
+			purged++
+		}
+	})
+
+	writeJson(rw, map[string]int{"purged": purged})
+}
+
+// filter builds an entry filter from the match and pattern query params
+func (h *Handler) filter(req *http.Request) (func(e cache.Entry) bool, error) {
+	filter := func(e cache.Entry) bool { return true }
+	q := req.URL.Query()
+
+	if m := q.Get("match"); m != "" {
+		re, err := regexp.Compile(m)
+		if err != nil {
+			return nil, err
+		}
+		prev := filter
+		filter = func(e cache.Entry) bool { return prev(e) && re.MatchString(e.URL) }
+	}
+
+	if p := q.Get("pattern"); p != "" {
+		pattern := h.findPattern(p)
+		if pattern == nil {
+			return nil, errUnknownPattern(p)
+		}
+		prev := filter
+		filter = func(e cache.Entry) bool {
+			match, matched := h.Patterns.MatchString(e.URL)
+			return prev(e) && match && matched == pattern
+		}
+	}
+
+	return filter, nil
+}
+
+func (h *Handler) findPattern(s string) *cache.CachePattern {
+	for _, p := range h.Patterns {
+		if p.String() == s {
+			return p
+		}
+	}
+
+	return nil
+}
+
+type errUnknownPattern string
+
+func (e errUnknownPattern) Error() string {
+	return "unknown cache pattern " + string(e)
+}
+
+type patternJson struct {
+	Pattern string `json:"pattern"`
+	MaxAge  string `json:"max_age"`
+	Entries int    `json:"entries"`
+	Size    int64  `json:"size"`
+}
+
+func (h *Handler) patterns(rw http.ResponseWriter, req *http.Request) {
+	patterns := make([]patternJson, len(h.Patterns))
+	index := map[*cache.CachePattern]int{}
+
+	for i, p := range h.Patterns {
+		patterns[i] = patternJson{Pattern: p.String(), MaxAge: p.Duration.String()}
+		index[p] = i
+	}
+
+	h.Cache.Each(func(e cache.Entry) {
+		if match, p := h.Patterns.MatchString(e.URL); match {
+			patterns[index[p]].Entries++
+			patterns[index[p]].Size += e.Size
+		}
+	})
+
+	writeJson(rw, patterns)
+}
+
+func (h *Handler) expire(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJson(rw, map[string]int{"expired": h.Cache.Expire()})
+}
+
+func writeJson(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(v); err != nil {
+		log.Printf("error encoding json: %s", err.Error())
+	}
+}
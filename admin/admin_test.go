@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lox/package-proxy/cache"
+)
+
+var testPatterns = cache.CachePatternSlice{
+	cache.NewPattern(`deb$`, time.Hour),
+	cache.NewPattern(`Release$`, time.Minute),
+}
+
+func newTestHandler(urls ...string) *Handler {
+	c := cache.NewMapCache()
+	for _, u := range urls {
+		c.Write(cache.Key(u), u, strings.NewReader("llamas"), time.Hour)
+	}
+
+	return NewHandler(c, testPatterns)
+}
+
+func doRequest(h http.Handler, method, path string, v interface{}) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if v != nil && rw.Code == http.StatusOK {
+		json.Unmarshal(rw.Body.Bytes(), v)
+	}
+
+	return rw
+}
+
+func TestListEntriesFiltersByRegex(t *testing.T) {
+	h := newTestHandler(
+		"http://archive.ubuntu.com/ubuntu/pool/main/a/a.deb",
+		"http://archive.ubuntu.com/ubuntu/dists/trusty/Release",
+	)
+
+	var entries []entryJson
+	doRequest(h, "GET", "/entries?match="+url.QueryEscape(`\.deb$`), &entries)
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+
+	if entries[0].Size != 6 || entries[0].Pattern != `deb$` {
+		t.Fatalf("Unexpected entry %#v", entries[0])
+	}
+}
+
+func TestPurgeSingleUrl(t *testing.T) {
+	u := "http://archive.ubuntu.com/ubuntu/pool/main/a/a.deb"
+	h := newTestHandler(u)
+
+	path := "/entries?url=" + url.QueryEscape(u)
+	if rw := doRequest(h, "DELETE", path, nil); rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 purging, got %d", rw.Code)
+	}
+
+	if rw := doRequest(h, "DELETE", path, nil); rw.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 purging a missing url, got %d", rw.Code)
+	}
+}
+
+func TestPurgeByPattern(t *testing.T) {
+	h := newTestHandler(
+		"http://archive.ubuntu.com/ubuntu/pool/main/a/a.deb",
+		"http://archive.ubuntu.com/ubuntu/pool/main/b/b.deb",
+		"http://archive.ubuntu.com/ubuntu/dists/trusty/Release",
+	)
+
+	var result map[string]int
+	doRequest(h, "DELETE", "/entries?pattern="+url.QueryEscape(`deb$`), &result)
+
+	if result["purged"] != 2 {
+		t.Fatalf("Expected 2 entries purged, got %d", result["purged"])
+	}
+
+	if rw := doRequest(h, "DELETE", "/entries?pattern=nope", nil); rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown pattern, got %d", rw.Code)
+	}
+}
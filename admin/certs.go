@@ -0,0 +1,73 @@
+package admin
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lox/package-proxy/mitm"
+)
+
+// CertsHandler lists and revokes generated leaf certificates.
+//
+//	GET    /certs              list certificates
+//	DELETE /certs?host=<host>  revoke a host's certificate, it's regenerated on next use
+type CertsHandler struct {
+	Store *mitm.CertStore
+}
+
+func NewCertsHandler(store *mitm.CertStore) *CertsHandler {
+	return &CertsHandler{Store: store}
+}
+
+type certJson struct {
+	Host      string    `json:"host"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+func (h *CertsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+		h.list(rw)
+	case "DELETE":
+		h.revoke(rw, req)
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *CertsHandler) list(rw http.ResponseWriter) {
+	leaves, err := h.Store.List()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	certs := make([]certJson, len(leaves))
+	for i, l := range leaves {
+		certs[i] = certJson{Host: l.Host, Serial: l.Serial, NotBefore: l.NotBefore, NotAfter: l.NotAfter}
+	}
+
+	writeJson(rw, certs)
+}
+
+func (h *CertsHandler) revoke(rw http.ResponseWriter, req *http.Request) {
+	host := req.URL.Query().Get("host")
+	if host == "" {
+		http.Error(rw, "host is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Store.Revoke(host); err == mitm.ErrCertNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("revoked certificate for %s", host)
+	writeJson(rw, map[string]int{"revoked": 1})
+}
@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lox/package-proxy/mitm"
+)
+
+func TestListAndRevokeCerts(t *testing.T) {
+	ca, err := mitm.NewCA(pkix.Name{CommonName: "Test CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := mitm.NewCertStore(ca, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get("registry.npmjs.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewCertsHandler(store)
+
+	var certs []certJson
+	doRequest(h, "GET", "/certs", &certs)
+
+	if len(certs) != 1 || certs[0].Host != "registry.npmjs.org" {
+		t.Fatalf("Unexpected certs %#v", certs)
+	}
+
+	if rw := doRequest(h, "DELETE", "/certs?host=registry.npmjs.org", nil); rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 revoking a cert, got %d", rw.Code)
+	}
+
+	if rw := doRequest(h, "DELETE", "/certs?host=registry.npmjs.org", nil); rw.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 revoking a missing cert, got %d", rw.Code)
+	}
+}
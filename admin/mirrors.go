@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/lox/package-proxy/mirror"
+)
+
+// MirrorRewriter is implemented by rewriters that pick between mirrors
+type MirrorRewriter interface {
+	String() string
+	MirrorStats() []mirror.MirrorStats
+}
+
+// MirrorsHandler shows the mirrors each rewriter uses and their stats from
+// live traffic.
+//
+//	GET /mirrors  list mirrors by rewriter, in the order they'd be used
+type MirrorsHandler struct {
+	Rewriters []MirrorRewriter
+}
+
+func NewMirrorsHandler(rewriters ...MirrorRewriter) *MirrorsHandler {
+	return &MirrorsHandler{Rewriters: rewriters}
+}
+
+func (h *MirrorsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mirrors := map[string][]mirror.MirrorStats{}
+	for _, r := range h.Rewriters {
+		mirrors[r.String()] = r.MirrorStats()
+	}
+
+	writeJson(rw, mirrors)
+}
@@ -0,0 +1,223 @@
+package apt
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/lox/package-proxy/cache"
+)
+
+// byHashPattern matches index urls like
+// dists/noble/main/binary-amd64/by-hash/SHA256/<digest>
+var byHashPattern = regexp.MustCompile(`^(.+/dists/.+/)by-hash/(MD5Sum|SHA1|SHA256|SHA512)/([0-9a-f]+)$`)
+
+// hashes are the digests apt uses, by their name in Release files
+var hashes = map[string]func() hash.Hash{
+	"MD5Sum": md5.New,
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// digest returns the hex digest of b with the named hash
+func digest(name string, b []byte) string {
+	h := hashes[name]()
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestCheck checks a body's size and digest as it's written
+type digestCheck struct {
+	hash.Hash
+	name   string
+	digest string
+	size   int64 // -1 if the size isn't known
+	source string
+	n      int64
+}
+
+func newDigestCheck(name, digest string, size int64, source string) *digestCheck {
+	return &digestCheck{Hash: hashes[name](), name: name, digest: digest, size: size, source: source}
+}
+
+func (c *digestCheck) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return c.Hash.Write(b)
+}
+
+func (c *digestCheck) Verify() error {
+	if c.size >= 0 && c.n != c.size {
+		return fmt.Errorf("size is %d, %s lists %d", c.n, c.source, c.size)
+	} else if d := hex.EncodeToString(c.Sum(nil)); d != c.digest {
+		return fmt.Errorf("%s digest is %s, %s lists %s", c.name, d, c.source, c.digest)
+	}
+
+	return nil
+}
+
+// byHash is a parsed by-hash url
+type byHash struct {
+	dir    string
+	hash   string
+	digest string
+}
+
+func parseByHash(u string) (byHash, bool) {
+	m := byHashPattern.FindStringSubmatch(u)
+	if m == nil {
+		return byHash{}, false
+	}
+
+	return byHash{dir: m[1], hash: m[2], digest: m[3]}, true
+}
+
+// ByHash is a cache hook for apt's by-hash indexes, which are named by the
+// digest of their content. Cached responses must match the digest, and
+// requests are answered from an index file in the same directory with the
+// same digest if it's already cached. Indexes are hashed when they're stored,
+// and by Load for those cached before the proxy started.
+type ByHash struct {
+	Cache cache.Cache
+
+	sync.RWMutex
+	// dirs are the digests of the cached indexes in each directory, by name
+	dirs map[string]map[string]indexDigests
+}
+
+// indexDigests are a cached index's digests by hash, keyed by when it was
+// stored
+type indexDigests struct {
+	storedAt time.Time
+	digests  map[string]string
+}
+
+func NewByHash(c cache.Cache) *ByHash {
+	return &ByHash{Cache: c, dirs: map[string]map[string]indexDigests{}}
+}
+
+func (b *ByHash) String() string {
+	return "apt by-hash"
+}
+
+// Match matches by-hash urls, and the indexes they can be answered from
+func (b *ByHash) Match(req *http.Request) bool {
+	u := cache.CanonicalUrl(req)
+	_, ok := parseByHash(u)
+	return ok || isIndex(u)
+}
+
+// Check checks a body hashes to the digest in the url
+func (b *ByHash) Check(req *http.Request) cache.Check {
+	bh, ok := parseByHash(cache.CanonicalUrl(req))
+	if !ok {
+		return nil
+	}
+
+	return newDigestCheck(bh.hash, bh.digest, -1, "the url")
+}
+
+// Find returns a cached index from the same directory with the digest in
+// the url, such as Packages.xz for its by-hash url
+func (b *ByHash) Find(req *http.Request) (*http.Response, error) {
+	bh, ok := parseByHash(cache.CanonicalUrl(req))
+	if !ok {
+		return nil, nil
+	}
+
+	b.RLock()
+	candidates := map[string]time.Time{}
+	for name, index := range b.dirs[bh.dir] {
+		if index.digests[bh.hash] == bh.digest {
+			candidates[bh.dir+name] = index.storedAt
+		}
+	}
+	b.RUnlock()
+
+	for u, storedAt := range candidates {
+		// skip indexes that have been stored again since they were hashed
+		key := cache.Key(u)
+		if e, err := b.Cache.Stat(key); err != nil || !e.StoredAt.Equal(storedAt) {
+			continue
+		}
+
+		resp, err := cache.ReadResponse(b.Cache, key, req)
+		if err != nil {
+			continue
+		}
+
+		log.Printf("serving %s from %s", cache.CanonicalUrl(req), u)
+		return resp, nil
+	}
+
+	return nil, nil
+}
+
+// Stored hashes an index when it's stored
+func (b *ByHash) Stored(req *http.Request, key string) {
+	if u := cache.CanonicalUrl(req); isIndex(u) {
+		b.index(key, u)
+	}
+}
+
+// Load hashes the indexes already in the cache
+func (b *ByHash) Load() {
+	b.Cache.Each(func(e cache.Entry) {
+		if isIndex(e.URL) {
+			b.index(e.Key, e.URL)
+		}
+	})
+}
+
+// index hashes a cached index with each hash apt uses, and replaces its
+// digests
+func (b *ByHash) index(key, u string) {
+	e, err := b.Cache.Stat(key)
+	if err != nil {
+		return
+	}
+
+	resp, err := cache.ReadResponse(b.Cache, key, nil)
+	if err != nil {
+		log.Printf("error hashing %s: %s", u, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	hs := map[string]hash.Hash{}
+	writers := []io.Writer{}
+	for name, h := range hashes {
+		hs[name] = h()
+		writers = append(writers, hs[name])
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), resp.Body); err != nil {
+		log.Printf("error hashing %s: %s", u, err.Error())
+		return
+	}
+
+	digests := map[string]string{}
+	for name, h := range hs {
+		digests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	dir, name := parent(u), path.Base(u)
+
+	b.Lock()
+	defer b.Unlock()
+	if b.dirs[dir] == nil {
+		b.dirs[dir] = map[string]indexDigests{}
+	}
+	b.dirs[dir][name] = indexDigests{storedAt: e.StoredAt, digests: digests}
+}
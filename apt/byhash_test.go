@@ -0,0 +1,128 @@
+package apt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/lox/package-proxy/cache"
+)
+
+const dists = "http://archive.ubuntu.com/ubuntu/dists/noble/main/binary-amd64/"
+
+// store caches a response for url with body
+func store(t *testing.T, c cache.Cache, url string, body []byte) {
+	req, _ := http.NewRequest("GET", url, nil)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+
+	b, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Write(cache.Key(url), url, bytes.NewReader(b), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check runs a verifier's check over body, it passes if there's no check
+func check(v cache.Verifier, req *http.Request, body []byte) error {
+	c := v.Check(req)
+	if c == nil {
+		return nil
+	}
+
+	c.Write(body)
+	return c.Verify()
+}
+
+func TestByHashVerifiesDigests(t *testing.T) {
+	b := NewByHash(cache.NewMapCache())
+	body := []byte("Package: bash\n")
+
+	req, _ := http.NewRequest("GET", dists+"by-hash/SHA256/"+digest("SHA256", body), nil)
+	if !b.Match(req) {
+		t.Fatal("Expected by-hash urls to match")
+	}
+
+	if err := check(b, req, body); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check(b, req, []byte("Package: llamas\n")); err == nil {
+		t.Fatal("Expected a body with a different digest to fail")
+	}
+
+	req, _ = http.NewRequest("GET", dists+"Packages.xz", nil)
+	if !b.Match(req) {
+		t.Fatal("Expected index urls to match so they're hashed when stored")
+	} else if b.Check(req) != nil {
+		t.Fatal("Expected no check for index urls")
+	}
+}
+
+func TestByHashFindsCachedIndexes(t *testing.T) {
+	c := cache.NewMapCache()
+	packages := []byte("Package: bash\n")
+	store(t, c, dists+"Packages.xz", packages)
+	store(t, c, dists+"Packages.gz", []byte("Package: zsh\n"))
+
+	b := NewByHash(c)
+	b.Load()
+	req, _ := http.NewRequest("GET", dists+"by-hash/SHA512/"+digest("SHA512", packages), nil)
+
+	resp, err := b.Find(req)
+	if err != nil {
+		t.Fatal(err)
+	} else if resp == nil {
+		t.Fatal("Expected the cached Packages.xz to be found")
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(body, packages) {
+		t.Fatalf("Unexpected body %q", body)
+	}
+
+	req, _ = http.NewRequest("GET", dists+"by-hash/SHA256/"+digest("SHA256", []byte("missing")), nil)
+	if resp, _ := b.Find(req); resp != nil {
+		t.Fatal("Expected no response for an uncached digest")
+	}
+}
+
+func TestByHashHashesStoredIndexes(t *testing.T) {
+	c := cache.NewMapCache()
+	b := NewByHash(c)
+	packages := []byte("Package: bash\n")
+	req, _ := http.NewRequest("GET", dists+"by-hash/SHA256/"+digest("SHA256", packages), nil)
+
+	store(t, c, dists+"Packages", packages)
+	if resp, _ := b.Find(req); resp != nil {
+		t.Fatal("Expected indexes that haven't been hashed not to be found")
+	}
+
+	indexReq, _ := http.NewRequest("GET", dists+"Packages", nil)
+	b.Stored(indexReq, cache.Key(dists+"Packages"))
+	if resp, _ := b.Find(req); resp == nil {
+		t.Fatal("Expected the stored index to be found")
+	} else {
+		resp.Body.Close()
+	}
+
+	// stored again without being hashed, so the digest is out of date
+	time.Sleep(time.Millisecond)
+	store(t, c, dists+"Packages", []byte("Package: zsh\n"))
+	if resp, _ := b.Find(req); resp != nil {
+		t.Fatal("Expected an index stored since it was hashed not to be found")
+	}
+}
@@ -0,0 +1,265 @@
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lox/package-proxy/cache"
+	"github.com/ulikunitz/xz"
+)
+
+// poolPattern matches package urls like pool/main/b/bash/bash_5.2_amd64.deb
+var poolPattern = regexp.MustCompile(`^(.+/)(pool/.+\.(deb|udeb|ddeb))$`)
+
+// packagesPattern matches the names of Packages indexes
+var packagesPattern = regexp.MustCompile(`^Packages(\.gz|\.bz2|\.xz)?$`)
+
+// byHashPackagesPattern matches by-hash urls for Packages indexes, which are
+// the only by-hash files in a binary-* directory besides its Release
+var byHashPackagesPattern = regexp.MustCompile(`/dists/.+/binary-[^/]+/by-hash/`)
+
+// PoolFile is a package listed in a Packages index
+type PoolFile struct {
+	Size   int64
+	SHA256 string
+}
+
+// Packages is a cache hook that checks packages under pool/ against the size
+// and SHA256 listed for them in cached Packages indexes. Packages that aren't
+// listed in any cached index aren't checked. Indexes are parsed when they're
+// stored, and by Load for those cached before the proxy started.
+type Packages struct {
+	Cache cache.Cache
+
+	sync.RWMutex
+	// roots are the files listed by the last index stored in each index
+	// directory, by archive root
+	roots map[string]map[string]map[string]PoolFile
+}
+
+func NewPackages(c cache.Cache) *Packages {
+	return &Packages{Cache: c, roots: map[string]map[string]map[string]PoolFile{}}
+}
+
+func (p *Packages) String() string {
+	return "apt packages"
+}
+
+// isPackages returns whether a url is a Packages index, by name or by-hash
+func isPackages(u string) bool {
+	if strings.Contains(u, "/by-hash/") {
+		return byHashPackagesPattern.MatchString(u)
+	}
+
+	return strings.Contains(u, "/dists/") && packagesPattern.MatchString(path.Base(u))
+}
+
+// indexDir returns the directory of a Packages index url, the compressed
+// and by-hash variants of an index share one
+func indexDir(u string) string {
+	if i := strings.Index(u, "/by-hash/"); i != -1 {
+		return u[:i+1]
+	}
+
+	return parent(u)
+}
+
+func (p *Packages) Match(req *http.Request) bool {
+	u := cache.CanonicalUrl(req)
+	return poolPattern.MatchString(u) || isPackages(u)
+}
+
+// poolCheck checks a package against the entries that list it
+type poolCheck struct {
+	hash.Hash
+	listed []PoolFile
+	n      int64
+}
+
+func (c *poolCheck) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return c.Hash.Write(b)
+}
+
+func (c *poolCheck) Verify() error {
+	d := hex.EncodeToString(c.Sum(nil))
+
+	var err error
+	for _, f := range c.listed {
+		if c.n != f.Size {
+			err = fmt.Errorf("size is %d, the index lists %d", c.n, f.Size)
+		} else if f.SHA256 != "" && d != f.SHA256 {
+			err = fmt.Errorf("SHA256 digest is %s, the index lists %s", d, f.SHA256)
+		} else {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// Check checks a package matches a cached index that lists it. Indexes from
+// the same archive are preferred, as pool/ urls can be canonicalized to a
+// different host than the indexes were fetched from.
+func (p *Packages) Check(req *http.Request) cache.Check {
+	m := poolPattern.FindStringSubmatch(cache.CanonicalUrl(req))
+	if m == nil {
+		return nil
+	}
+
+	listed := p.listed(m[1], m[2])
+	if len(listed) == 0 {
+		return nil
+	}
+
+	return &poolCheck{Hash: sha256.New(), listed: listed}
+}
+
+// listed returns the entries for a file in the indexes of an archive root,
+// or in any index if none of the root's list it
+func (p *Packages) listed(root, name string) []PoolFile {
+	p.RLock()
+	defer p.RUnlock()
+
+	local, other := []PoolFile{}, []PoolFile{}
+	for r, indexes := range p.roots {
+		for _, files := range indexes {
+			if f, ok := files[name]; ok && r == root {
+				local = append(local, f)
+			} else if ok {
+				other = append(other, f)
+			}
+		}
+	}
+
+	if len(local) > 0 {
+		return local
+	}
+	return other
+}
+
+// Stored parses a Packages index when it's stored
+func (p *Packages) Stored(req *http.Request, key string) {
+	if u := cache.CanonicalUrl(req); isPackages(u) {
+		p.index(key, u)
+	}
+}
+
+// Load parses the Packages indexes already in the cache
+func (p *Packages) Load() {
+	p.Cache.Each(func(e cache.Entry) {
+		if isPackages(e.URL) {
+			p.index(e.Key, e.URL)
+		}
+	})
+}
+
+// index parses a cached Packages index and replaces the entries for its
+// directory
+func (p *Packages) index(key, u string) {
+	files, err := p.parse(key)
+	if err != nil {
+		log.Printf("error parsing %s: %s", u, err.Error())
+		return
+	}
+
+	root := u[:strings.Index(u, "/dists/")+1]
+
+	p.Lock()
+	defer p.Unlock()
+	if p.roots[root] == nil {
+		p.roots[root] = map[string]map[string]PoolFile{}
+	}
+	p.roots[root][indexDir(u)] = files
+}
+
+// parse reads a cached Packages index, decompressing it by its magic bytes as
+// by-hash urls have no extension
+func (p *Packages) parse(key string) (map[string]PoolFile, error) {
+	stream, err := p.Cache.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := bufio.NewReader(resp.Body)
+	magic, _ := body.Peek(6)
+
+	var r io.Reader = body
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		if r, err = gzip.NewReader(body); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		r = bzip2.NewReader(body)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		if r, err = xz.NewReader(body); err != nil {
+			return nil, err
+		}
+	}
+
+	return ParsePackages(r)
+}
+
+// ParsePackages reads the size and SHA256 of each file in a Packages index
+func ParsePackages(r io.Reader) (map[string]PoolFile, error) {
+	files := map[string]PoolFile{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	name, f := "", PoolFile{}
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// a blank line ends a package's stanza
+		if line == "" {
+			if name != "" {
+				files[name] = f
+			}
+			name, f = "", PoolFile{}
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.HasPrefix(line, " ") {
+			continue
+		}
+
+		value := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "Filename":
+			name = value
+		case "Size":
+			f.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "SHA256":
+			f.SHA256 = value
+		}
+	}
+
+	if name != "" {
+		files[name] = f
+	}
+
+	return files, scanner.Err()
+}
@@ -0,0 +1,128 @@
+package apt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/lox/package-proxy/cache"
+)
+
+const pool = "http://archive.ubuntu.com/ubuntu/pool/main/b/bash/bash_5.2_amd64.deb"
+
+// packagesIndex returns a gzipped Packages index listing deb as bash
+func packagesIndex(deb []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	fmt.Fprintf(w, "Package: bash\nVersion: 5.2\nFilename: pool/main/b/bash/bash_5.2_amd64.deb\nSize: %d\nSHA256: %s\nDescription: GNU Bourne Again SHell\n multi-line\n\nPackage: zsh\nFilename: pool/main/z/zsh/zsh_5.9_amd64.deb\nSize: 1\n",
+		len(deb), digest("SHA256", deb))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestParsePackages(t *testing.T) {
+	files, err := ParsePackages(bytes.NewBufferString("Package: bash\nFilename: pool/main/b/bash/bash_5.2_amd64.deb\nSize: 12\nSHA256: abc\n\nPackage: zsh\nFilename: pool/main/z/zsh/zsh_5.9_amd64.deb\nSize: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f := files["pool/main/b/bash/bash_5.2_amd64.deb"]; f.Size != 12 || f.SHA256 != "abc" {
+		t.Fatalf("Unexpected bash entry %v", f)
+	} else if f := files["pool/main/z/zsh/zsh_5.9_amd64.deb"]; f.Size != 1 {
+		t.Fatalf("Unexpected zsh entry %v", f)
+	}
+}
+
+func TestPackagesVerifyDebs(t *testing.T) {
+	c := cache.NewMapCache()
+	deb := []byte("!<arch>\ndebian-binary")
+	store(t, c, dists+"Packages.gz", packagesIndex(deb))
+
+	p := NewPackages(c)
+	p.Load()
+	req, _ := http.NewRequest("GET", pool, nil)
+	if !p.Match(req) {
+		t.Fatal("Expected pool urls to match")
+	}
+
+	if err := check(p, req, deb); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check(p, req, []byte("!<arch>\ndebian-binarY")); err == nil {
+		t.Fatal("Expected a deb with a different digest to fail")
+	}
+
+	if err := check(p, req, deb[1:]); err == nil {
+		t.Fatal("Expected a deb with a different size to fail")
+	}
+
+	req, _ = http.NewRequest("GET", "http://archive.ubuntu.com/ubuntu/pool/main/f/fish/fish_3.7_amd64.deb", nil)
+	if err := check(p, req, deb); err != nil {
+		t.Fatalf("Expected unlisted debs to pass, got %s", err)
+	}
+}
+
+func TestPackagesVerifyCanonicalDebsAgainstOtherHosts(t *testing.T) {
+	c := cache.NewMapCache()
+	deb := []byte("!<arch>\ndebian-binary")
+	store(t, c, "http://ftp.us.debian.org/debian/dists/bookworm/main/binary-amd64/Packages.gz", packagesIndex(deb))
+
+	p := NewPackages(c)
+	p.Load()
+	req, _ := http.NewRequest("GET", "http://deb.debian.org/debian/pool/main/b/bash/bash_5.2_amd64.deb", nil)
+
+	if err := check(p, req, deb); err != nil {
+		t.Fatal(err)
+	} else if err := check(p, req, deb[1:]); err == nil {
+		t.Fatal("Expected a deb with a different size to fail")
+	}
+}
+
+func TestPackagesIndexStoredIndexes(t *testing.T) {
+	c := cache.NewMapCache()
+	deb := []byte("!<arch>\ndebian-binary")
+
+	p := NewPackages(c)
+	p.Load()
+
+	req, _ := http.NewRequest("GET", pool, nil)
+	if p.Check(req) != nil {
+		t.Fatal("Expected no check without a cached index")
+	}
+
+	store(t, c, dists+"Packages.gz", packagesIndex(deb))
+	indexReq, _ := http.NewRequest("GET", dists+"Packages.gz", nil)
+	if !p.Match(indexReq) {
+		t.Fatal("Expected Packages indexes to match")
+	}
+	p.Stored(indexReq, cache.Key(dists+"Packages.gz"))
+
+	if err := check(p, req, deb[1:]); err == nil {
+		t.Fatal("Expected the stored index to be used")
+	}
+}
+
+func TestPackagesIndexByHashIndexes(t *testing.T) {
+	c := cache.NewMapCache()
+	deb := []byte("!<arch>\ndebian-binary")
+	index := packagesIndex(deb)
+	u := "http://archive.ubuntu.com/ubuntu/dists/noble/main/binary-amd64/by-hash/SHA256/" + digest("SHA256", index)
+	store(t, c, u, index)
+
+	p := NewPackages(c)
+	req, _ := http.NewRequest("GET", u, nil)
+	if !p.Match(req) {
+		t.Fatal("Expected by-hash Packages indexes to match")
+	}
+	p.Stored(req, cache.Key(u))
+
+	req, _ = http.NewRequest("GET", pool, nil)
+	if err := check(p, req, deb); err != nil {
+		t.Fatal(err)
+	} else if err := check(p, req, deb[1:]); err == nil {
+		t.Fatal("Expected the by-hash index to be used")
+	}
+}
@@ -0,0 +1,81 @@
+package apt
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// strongest are the hashes in a Release file, strongest first
+var strongest = []string{"SHA512", "SHA256", "SHA1", "MD5Sum"}
+
+// Release is the index files listed in a Release or InRelease file
+type Release struct {
+	// ByHash is set if the indexes can be fetched by-hash
+	ByHash bool
+	Files  map[string]*IndexFile
+}
+
+// IndexFile is an index listed in a Release file, with its digests by hash
+type IndexFile struct {
+	Size    int64
+	Digests map[string]string
+}
+
+// Digest returns the strongest hash of a file and its digest
+func (f *IndexFile) Digest() (string, string) {
+	for _, name := range strongest {
+		if d, ok := f.Digests[name]; ok {
+			return name, d
+		}
+	}
+
+	return "", ""
+}
+
+// ParseRelease reads the checksums from a Release or clearsigned InRelease
+func ParseRelease(r io.Reader) (*Release, error) {
+	release := &Release{Files: map[string]*IndexFile{}}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	hash := ""
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "-----BEGIN PGP SIGNATURE") {
+			break
+		} else if strings.HasPrefix(line, " ") {
+			fields := strings.Fields(line)
+			if _, ok := hashes[hash]; !ok || len(fields) != 3 {
+				continue
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			f, ok := release.Files[fields[2]]
+			if !ok {
+				f = &IndexFile{Size: size, Digests: map[string]string{}}
+				release.Files[fields[2]] = f
+			}
+			f.Digests[hash] = fields[0]
+			continue
+		}
+
+		// a new field, which is a hash if it has no value
+		kv := strings.SplitN(line, ":", 2)
+		hash = ""
+		if len(kv) != 2 {
+			continue
+		} else if strings.TrimSpace(kv[1]) == "" {
+			hash = kv[0]
+		} else if kv[0] == "Acquire-By-Hash" {
+			release.ByHash = strings.TrimSpace(kv[1]) == "yes"
+		}
+	}
+
+	return release, scanner.Err()
+}
@@ -0,0 +1,274 @@
+package apt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lox/package-proxy/cache"
+)
+
+// Snapshots is a cache hook that keeps a suite's index files consistent with
+// the Release file being served for it, so clients don't get a Hash Sum
+// mismatch from a new Release and an old Packages or the other way round.
+//
+// Cached indexes are only served while they match the cached InRelease or
+// Release, and ones that don't are evicted. Indexes that aren't cached are
+// fetched by-hash as the version the Release lists, if the Release allows.
+// Indexes from upstream that don't match are served but not cached.
+type Snapshots struct {
+	Cache cache.Cache
+	// Patterns set how long by-hash indexes are cached for
+	Patterns cache.CachePatternSlice
+
+	sync.Mutex
+	releases map[string]*parsedRelease
+	digests  map[string]*cachedDigest
+}
+
+// parsedRelease is a parsed cached Release, keyed by when it was stored
+type parsedRelease struct {
+	storedAt time.Time
+	release  *Release
+}
+
+// cachedDigest is the digest of a cached index, keyed by when it was stored
+type cachedDigest struct {
+	storedAt time.Time
+	hash     string
+	digest   string
+}
+
+func NewSnapshots(c cache.Cache, patterns cache.CachePatternSlice) *Snapshots {
+	return &Snapshots{
+		Cache:    c,
+		Patterns: patterns,
+		releases: map[string]*parsedRelease{},
+		digests:  map[string]*cachedDigest{},
+	}
+}
+
+func (s *Snapshots) String() string {
+	return "apt snapshots"
+}
+
+// isIndex returns whether a url is an index under dists/, other than the
+// Release files and by-hash urls
+func isIndex(u string) bool {
+	if !strings.Contains(u, "/dists/") || strings.Contains(u, "/by-hash/") {
+		return false
+	}
+
+	switch path.Base(u) {
+	case "InRelease", "Release", "Release.gpg":
+		return false
+	}
+
+	return true
+}
+
+// isRelease returns whether a url is an InRelease or Release under dists/
+func isRelease(u string) bool {
+	switch path.Base(u) {
+	case "InRelease", "Release":
+		return strings.Contains(u, "/dists/")
+	}
+
+	return false
+}
+
+// Match matches indexes, and the Release files they're checked against
+func (s *Snapshots) Match(req *http.Request) bool {
+	u := cache.CanonicalUrl(req)
+	return isIndex(u) || isRelease(u)
+}
+
+// Preload stores Release files before they're served, so a client that
+// fetches an index right after a new Release can't be given one that
+// matches the old Release
+func (s *Snapshots) Preload(req *http.Request) bool {
+	return isRelease(cache.CanonicalUrl(req))
+}
+
+// staleCheck serves indexes that don't match the cached Release without
+// caching them, they're newer or older but not corrupt
+type staleCheck struct {
+	cache.Check
+}
+
+func (c staleCheck) Verify() error {
+	if err := c.Check.Verify(); err != nil {
+		return cache.Stale(err)
+	}
+
+	return nil
+}
+
+// Check checks an index matches the size and digest in the cached Release
+func (s *Snapshots) Check(req *http.Request) cache.Check {
+	u := cache.CanonicalUrl(req)
+	if !isIndex(u) {
+		return nil
+	}
+
+	f, dir := s.indexFile(u)
+	if f == nil {
+		return nil
+	}
+
+	hash, d := f.Digest()
+	return staleCheck{newDigestCheck(hash, d, f.Size, "the release in "+dir)}
+}
+
+// Alias evicts a cached index that doesn't match the cached Release, and
+// answers an index that isn't cached with the version the Release lists
+// by-hash
+func (s *Snapshots) Alias(req *http.Request) *http.Request {
+	u := cache.CanonicalUrl(req)
+	if !isIndex(u) {
+		return nil
+	}
+
+	f, dir := s.indexFile(u)
+	if f == nil {
+		return nil
+	}
+
+	hash, d := f.Digest()
+	key := cache.Key(u)
+	if entry, err := s.Cache.Stat(key); err == nil {
+		if s.digest(key, entry, hash) == d {
+			return nil
+		}
+
+		log.Printf("evicting %s, it doesn't match the release in %s", u, dir)
+		if err := s.Cache.Delete(key); err != nil && err != cache.ErrNotFound {
+			log.Printf("error evicting %s: %s", u, err.Error())
+		}
+	}
+
+	if !s.byHash(dir) {
+		return nil
+	}
+
+	// the request has been rewritten, fetch by-hash from the same host
+	aliased := req.Clone(req.Context())
+	aliased.URL.Path = path.Dir(req.URL.Path) + "/by-hash/" + hash + "/" + d
+	aliased.URL.RawPath = ""
+	aliased.Header.Set(cache.CanonicalUrlHeader, parent(u)+"by-hash/"+hash+"/"+d)
+
+	// by-hash urls are cached for as long as their own pattern says, not the index's
+	if ok, pattern := s.Patterns.MatchString(cache.CanonicalUrl(aliased)); ok {
+		aliased.Header.Set(cache.MaxAgeHeader, pattern.Duration.String())
+	} else {
+		aliased.Header.Del(cache.MaxAgeHeader)
+	}
+	return aliased
+}
+
+// parent returns the directory of a url, with a trailing slash
+func parent(u string) string {
+	return u[:strings.LastIndex(u, "/")+1]
+}
+
+// indexFile returns the entry for an index in the nearest cached Release,
+// and the directory of that Release
+func (s *Snapshots) indexFile(u string) (*IndexFile, string) {
+	for dir := parent(u); strings.Contains(dir, "/dists/"); dir = parent(strings.TrimSuffix(dir, "/")) {
+		release := s.release(dir)
+		if release == nil {
+			continue
+		}
+
+		f, ok := release.Files[strings.TrimPrefix(u, dir)]
+		if !ok {
+			return nil, dir
+		}
+		return f, dir
+	}
+
+	return nil, ""
+}
+
+func (s *Snapshots) byHash(dir string) bool {
+	release := s.release(dir)
+	return release != nil && release.ByHash
+}
+
+// digest returns the digest of a cached index, it's only read again when the
+// index is stored again
+func (s *Snapshots) digest(key string, entry cache.Entry, hash string) string {
+	s.Lock()
+	cached, ok := s.digests[key]
+	s.Unlock()
+	if ok && cached.storedAt.Equal(entry.StoredAt) && cached.hash == hash {
+		return cached.digest
+	}
+
+	stream, err := s.Cache.Read(key)
+	if err != nil {
+		return ""
+	}
+	defer stream.Close()
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), nil)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	h := hashes[hash]()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return ""
+	}
+
+	d := hex.EncodeToString(h.Sum(nil))
+	s.Lock()
+	s.digests[key] = &cachedDigest{storedAt: entry.StoredAt, hash: hash, digest: d}
+	s.Unlock()
+	return d
+}
+
+// release returns the parsed InRelease or Release cached for a directory
+func (s *Snapshots) release(dir string) *Release {
+	for _, name := range []string{"InRelease", "Release"} {
+		key := cache.Key(dir + name)
+		entry, err := s.Cache.Stat(key)
+		if err != nil {
+			continue
+		}
+
+		s.Lock()
+		parsed, ok := s.releases[key]
+		s.Unlock()
+		if ok && parsed.storedAt.Equal(entry.StoredAt) {
+			return parsed.release
+		}
+
+		req, _ := http.NewRequest("GET", dir+name, nil)
+		resp, err := cache.ReadResponse(s.Cache, key, req)
+		if err != nil {
+			continue
+		}
+
+		release, err := ParseRelease(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("error parsing %s%s: %s", dir, name, err.Error())
+			continue
+		}
+
+		s.Lock()
+		s.releases[key] = &parsedRelease{storedAt: entry.StoredAt, release: release}
+		s.Unlock()
+		return release
+	}
+
+	return nil
+}
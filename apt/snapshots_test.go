@@ -0,0 +1,135 @@
+package apt
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lox/package-proxy/cache"
+)
+
+const suite = "http://archive.ubuntu.com/ubuntu/dists/noble/"
+
+// release returns an InRelease listing packages as main/binary-amd64/Packages.gz
+func release(packages []byte) []byte {
+	return []byte(fmt.Sprintf(`-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+Origin: Ubuntu
+Suite: noble
+Acquire-By-Hash: yes
+MD5Sum:
+ %s %d main/binary-amd64/Packages.gz
+SHA256:
+ %s %d main/binary-amd64/Packages.gz
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCgAdFiEE
+-----END PGP SIGNATURE-----
+`, digest("MD5Sum", packages), len(packages), digest("SHA256", packages), len(packages)))
+}
+
+func TestParseRelease(t *testing.T) {
+	packages := []byte("Package: bash\n")
+	r, err := ParseRelease(bytes.NewReader(release(packages)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.ByHash {
+		t.Fatal("Expected Acquire-By-Hash to be parsed")
+	}
+
+	f, ok := r.Files["main/binary-amd64/Packages.gz"]
+	if !ok {
+		t.Fatalf("Expected Packages.gz to be listed, got %v", r.Files)
+	} else if f.Size != int64(len(packages)) {
+		t.Fatalf("Unexpected size %d", f.Size)
+	}
+
+	if hash, d := f.Digest(); hash != "SHA256" || d != digest("SHA256", packages) {
+		t.Fatalf("Expected the SHA256 digest, got %s %s", hash, d)
+	}
+}
+
+func TestSnapshotsVerifyAgainstTheCachedRelease(t *testing.T) {
+	c := cache.NewMapCache()
+	packages := []byte("Package: bash\n")
+	store(t, c, suite+"InRelease", release(packages))
+
+	s := NewSnapshots(c, nil)
+	req, _ := http.NewRequest("GET", dists+"Packages.gz", nil)
+	if !s.Match(req) {
+		t.Fatal("Expected index urls to match")
+	}
+
+	if err := check(s, req, packages); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check(s, req, []byte("Package: zsh\n")); err == nil || !cache.IsStale(err) {
+		t.Fatalf("Expected an index the release doesn't list to be stale, got %v", err)
+	}
+
+	req, _ = http.NewRequest("GET", dists+"by-hash/SHA256/abc", nil)
+	if s.Match(req) {
+		t.Fatal("Expected by-hash urls not to match")
+	}
+
+	req, _ = http.NewRequest("GET", suite+"InRelease", nil)
+	if !s.Match(req) || !s.Preload(req) {
+		t.Fatal("Expected release urls to be stored before they're served")
+	} else if s.Check(req) != nil || s.Alias(req) != nil {
+		t.Fatal("Expected release urls not to be checked or aliased")
+	}
+
+	req, _ = http.NewRequest("GET", dists+"Packages.gz", nil)
+	if s.Preload(req) {
+		t.Fatal("Expected indexes to be stored in the background")
+	}
+}
+
+func TestSnapshotsAliasIndexesByHash(t *testing.T) {
+	c := cache.NewMapCache()
+	packages := []byte("Package: bash\n")
+	store(t, c, suite+"InRelease", release(packages))
+	s := NewSnapshots(c, cache.CachePatternSlice{
+		cache.NewPattern(`/by-hash/`, time.Hour*24),
+		cache.NewPattern(`Packages\.gz$`, time.Hour),
+	})
+
+	req, _ := http.NewRequest("GET", dists+"Packages.gz", nil)
+	req.URL.Host = "mirror.example.com"
+	req.Header.Set(cache.CanonicalUrlHeader, dists+"Packages.gz")
+	req.Header.Set(cache.MaxAgeHeader, time.Hour.String())
+
+	aliased := s.Alias(req)
+	if aliased == nil {
+		t.Fatal("Expected an uncached index to be aliased by-hash")
+	}
+
+	byHash := "by-hash/SHA256/" + digest("SHA256", packages)
+	if u := aliased.URL.String(); u != "http://mirror.example.com/ubuntu/dists/noble/main/binary-amd64/"+byHash {
+		t.Fatalf("Unexpected upstream url %s", u)
+	} else if u := cache.CanonicalUrl(aliased); u != dists+byHash {
+		t.Fatalf("Unexpected canonical url %s", u)
+	} else if maxAge := aliased.Header.Get(cache.MaxAgeHeader); maxAge != (time.Hour * 24).String() {
+		t.Fatalf("Expected the by-hash max age, got %s", maxAge)
+	}
+
+	// a cached index that matches the release is served as it is
+	store(t, c, dists+"Packages.gz", packages)
+	if s.Alias(req) != nil {
+		t.Fatal("Expected a matching cached index not to be aliased")
+	}
+
+	// one that doesn't is evicted
+	store(t, c, dists+"Packages.gz", []byte("Package: zsh\n"))
+	if s.Alias(req) == nil {
+		t.Fatal("Expected a stale cached index to be aliased")
+	} else if c.Has(cache.Key(dists + "Packages.gz")) {
+		t.Fatal("Expected a stale cached index to be evicted")
+	}
+}
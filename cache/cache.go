@@ -1,13 +1,47 @@
 package cache
 
 import (
+	"errors"
 	"io"
 
 	"time"
 )
 
+// ErrNotFound is returned when a key isn't in the cache
+var ErrNotFound = errors.New("key not found in cache")
+
 type Cache interface {
-	Write(key string, r io.Reader, maxAge time.Duration) error
+	Write(key, url string, r io.Reader, maxAge time.Duration) error
 	Read(key string) (io.ReadCloser, error)
 	Has(key string) bool
+	Delete(key string) error
+	Stat(key string) (Entry, error)
+	Each(fn func(e Entry))
+	Expire() int
+	Close() error
+}
+
+// Entry describes an item stored in the cache
+type Entry struct {
+	Key      string
+	URL      string
+	Size     int64
+	StoredAt time.Time
+	MaxAge   time.Duration
+	Hits     int64
+}
+
+// TTL returns how long until the entry expires
+func (e Entry) TTL() time.Duration {
+	return e.StoredAt.Add(e.MaxAge).Sub(time.Now())
+}
+
+// Stats returns the number of entries in a cache and their total size
+func Stats(c Cache) (entries int, size int64) {
+	c.Each(func(e Entry) {
+		entries++
+		size += e.Size
+	})
+
+	return entries, size
 }
@@ -54,16 +54,73 @@ type diskCache struct {
 	expirer *Expirer
 }
 
-func (c *diskCache) Write(key string, r io.Reader, maxAge time.Duration) error {
+func (c *diskCache) Write(key, url string, r io.Reader, maxAge time.Duration) error {
+	counter := &countingReader{Reader: r}
+	if err := c.diskv.WriteStream(key, counter, true); err != nil {
+		return err
+	}
+
 	c.expirer.SetLastUpdated(key, time.Now())
 	c.expirer.SetMaxAge(key, maxAge)
-	return c.diskv.WriteStream(key, r, true)
+	c.expirer.SetURL(key, url)
+	c.expirer.SetSize(key, counter.n)
+	return nil
 }
 
 func (c *diskCache) Read(key string) (io.ReadCloser, error) {
-	return c.diskv.ReadStream(key)
+	stream, err := c.diskv.ReadStream(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.expirer.Hit(key)
+	return stream, nil
 }
 
 func (c *diskCache) Has(key string) bool {
 	return c.diskv.Has(key)
 }
+
+func (c *diskCache) Delete(key string) error {
+	if !c.diskv.Has(key) {
+		return ErrNotFound
+	}
+
+	c.expirer.Remove(key)
+	return c.diskv.Erase(key)
+}
+
+func (c *diskCache) Stat(key string) (Entry, error) {
+	if !c.diskv.Has(key) {
+		return Entry{}, ErrNotFound
+	}
+
+	e, _ := c.expirer.Entry(key)
+	return e, nil
+}
+
+func (c *diskCache) Each(fn func(e Entry)) {
+	c.expirer.Each(fn)
+}
+
+func (c *diskCache) Expire() int {
+	return c.expirer.Expire(time.Now())
+}
+
+// Close stops expiration and persists the expiry index
+func (c *diskCache) Close() error {
+	c.expirer.Stop()
+	return c.expirer.Save()
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
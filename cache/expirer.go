@@ -7,6 +7,8 @@ import (
 	"os"
 	"sync"
 	"time"
+
+	"github.com/lox/package-proxy/metrics"
 )
 
 const (
@@ -16,9 +18,11 @@ const (
 type ExpireFunc func(key string)
 
 type Expirer struct {
-	timer      <-chan time.Time
+	stop       chan struct{}
+	stopOnce   sync.Once
 	records    map[string]keyRecord
 	mutex      sync.RWMutex
+	saveMutex  sync.Mutex
 	expireFunc ExpireFunc
 	jsonFile   string
 	dirty      bool
@@ -27,6 +31,20 @@ type Expirer struct {
 type keyRecord struct {
 	MaxAge      time.Duration
 	TimeUpdated time.Time
+	URL         string
+	Size        int64
+	Hits        int64
+}
+
+func (r *keyRecord) Entry(key string) Entry {
+	return Entry{
+		Key:      key,
+		URL:      r.URL,
+		Size:     r.Size,
+		StoredAt: r.TimeUpdated,
+		MaxAge:   r.MaxAge,
+		Hits:     r.Hits,
+	}
 }
 
 func (r *keyRecord) TimeToLive() time.Duration {
@@ -37,6 +55,7 @@ func NewExpirer(e ExpireFunc) *Expirer {
 	return &Expirer{
 		records:    map[string]keyRecord{},
 		expireFunc: e,
+		stop:       make(chan struct{}),
 	}
 }
 
@@ -64,77 +83,165 @@ func LoadExpirer(jsonFile string, e ExpireFunc) (*Expirer, error) {
 	return expirer, nil
 }
 
+// Save writes the records to the json file. They're copied under the lock
+// and written outside it, so cache hits don't wait on the disk.
 func (e *Expirer) Save() error {
-	log.Printf("saving %d records to %s", len(e.records), e.jsonFile)
+	e.saveMutex.Lock()
+	defer e.saveMutex.Unlock()
 
-	jsonBlob, err := json.Marshal(e.records)
-	if err != nil {
-		return err
+	e.mutex.Lock()
+	records := make(map[string]keyRecord, len(e.records))
+	for key, r := range e.records {
+		records[key] = r
+	}
+	e.dirty = false
+	e.mutex.Unlock()
+
+	log.Printf("saving %d records to %s", len(records), e.jsonFile)
+
+	jsonBlob, err := json.Marshal(records)
+	if err == nil {
+		err = ioutil.WriteFile(e.jsonFile, jsonBlob, 0777)
 	}
 
-	err = ioutil.WriteFile(e.jsonFile, jsonBlob, 0777)
 	if err != nil {
+		e.mutex.Lock()
+		e.dirty = true
+		e.mutex.Unlock()
 		return err
 	}
 
-	e.dirty = false
 	return nil
 }
 
-func (e *Expirer) SetLastUpdated(key string, t time.Time) {
+// update applies fn to the record for key, creating it if needed
+func (e *Expirer) update(key string, fn func(r *keyRecord)) {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
-	if _, ok := e.records[key]; ok {
-		r := e.records[key]
-		r.TimeUpdated = t
-		e.records[key] = r
-	} else {
-		e.records[key] = keyRecord{
-			TimeUpdated: t,
-			MaxAge:      defaultMaxAge,
-		}
+	r, ok := e.records[key]
+	if !ok {
+		r = keyRecord{MaxAge: defaultMaxAge}
 	}
 
+	fn(&r)
+	e.records[key] = r
 	e.dirty = true
 }
 
+func (e *Expirer) SetLastUpdated(key string, t time.Time) {
+	e.update(key, func(r *keyRecord) { r.TimeUpdated = t })
+}
+
 func (e *Expirer) SetMaxAge(key string, d time.Duration) {
+	e.update(key, func(r *keyRecord) { r.MaxAge = d })
+}
+
+func (e *Expirer) SetURL(key string, url string) {
+	e.update(key, func(r *keyRecord) { r.URL = url })
+}
+
+func (e *Expirer) SetSize(key string, size int64) {
+	e.update(key, func(r *keyRecord) { r.Size = size })
+}
+
+// Hit increments the hit count of an existing record. Hits alone don't make
+// the records dirty, they're saved with the next change or on Close.
+func (e *Expirer) Hit(key string) {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
-	if _, ok := e.records[key]; ok {
-		r := e.records[key]
-		r.MaxAge = d
+	if r, ok := e.records[key]; ok {
+		r.Hits++
 		e.records[key] = r
-	} else {
-		e.records[key] = keyRecord{
-			MaxAge: d,
-		}
 	}
-
-	e.dirty = true
 }
 
-func (e *Expirer) Expire(t time.Time) {
+// Entry returns the record for key as an Entry
+func (e *Expirer) Entry(key string) (Entry, bool) {
 	e.mutex.RLock()
 	defer e.mutex.RUnlock()
 
+	r, ok := e.records[key]
+	return r.Entry(key), ok
+}
+
+// Each calls fn with a snapshot of every record
+func (e *Expirer) Each(fn func(e Entry)) {
+	e.mutex.RLock()
+	entries := make([]Entry, 0, len(e.records))
+	for key, r := range e.records {
+		entries = append(entries, r.Entry(key))
+	}
+	e.mutex.RUnlock()
+
+	for _, entry := range entries {
+		fn(entry)
+	}
+}
+
+// Remove forgets a record without calling the expire func
+func (e *Expirer) Remove(key string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, ok := e.records[key]; ok {
+		delete(e.records, key)
+		e.dirty = true
+		metrics.Evictions.Inc()
+	}
+}
+
+// Expire calls the expire func for records past their max age, returning how many
+func (e *Expirer) Expire(t time.Time) int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	expired := 0
 	for key, r := range e.records {
 		ttl := r.TimeToLive()
 		if ttl <= 0 {
 			e.expireFunc(key)
 			delete(e.records, key)
+			e.dirty = true
+			expired++
 		}
 	}
+
+	metrics.Expirations.Add(float64(expired))
+	return expired
 }
 
+func (e *Expirer) isDirty() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.dirty
+}
+
+// Tick expires records and saves the index every d until Stop is called
 func (e *Expirer) Tick(d time.Duration) {
-	e.timer = time.Tick(d)
-	for now := range e.timer {
-		e.Expire(now)
-		if e.dirty {
-			e.Save()
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			e.Expire(now)
+			if e.isDirty() {
+				if err := e.Save(); err != nil {
+					log.Printf("error saving records: %s", err.Error())
+				}
+			}
+		case <-e.stop:
+			return
 		}
 	}
 }
+
+// Stop ends a running Tick, it's safe to call more than once
+func (e *Expirer) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+}
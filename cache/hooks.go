@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/lox/package-proxy/metrics"
+)
+
+// Hook lets a package format take part in caching the requests it matches.
+// Hooks implement Verifier, Finder, Aliaser, Indexer and Preloader as
+// needed. Hooks aren't used for HEAD requests, which have no body to check.
+type Hook interface {
+	Match(req *http.Request) bool
+}
+
+// Verifier checks response bodies before they're stored in the cache, and
+// as they're served from the cache. Responses that fail aren't stored, and
+// cached ones that fail are evicted.
+type Verifier interface {
+	// Check returns a check for a request's body, or nil if there's nothing
+	// to check
+	Check(req *http.Request) Check
+}
+
+// Check is written a response body as it's read
+type Check interface {
+	io.Writer
+
+	// Verify returns an error if the body that was written doesn't match
+	Verify() error
+}
+
+// Finder answers a request that isn't cached from other cache entries, it
+// returns nil if it can't
+type Finder interface {
+	Find(req *http.Request) (*http.Response, error)
+}
+
+// Aliaser answers a request with the response to another one, such as an
+// index by its digest. The alias is looked up and fetched like any other
+// request. Alias returns nil to handle the request as it is.
+type Aliaser interface {
+	Alias(req *http.Request) *http.Request
+}
+
+// Indexer is told when a response it matches has been stored in the cache
+type Indexer interface {
+	Stored(req *http.Request, key string)
+}
+
+// Preloader has the responses it matches stored before they're served, for
+// responses other hooks read from the cache. Other responses are stored in
+// the background after they're served.
+type Preloader interface {
+	Preload(req *http.Request) bool
+}
+
+// staleError is a check failure for a response that's valid, but out of date
+// with other cached responses
+type staleError struct {
+	error
+}
+
+// Stale wraps a check error for a response that should be served but not
+// cached, rather than rejected
+func Stale(err error) error {
+	return staleError{err}
+}
+
+// IsStale returns whether a check error is from Stale
+func IsStale(err error) bool {
+	var stale staleError
+	return errors.As(err, &stale)
+}
+
+// ReadResponse reads a cached response for req, the body is streamed from
+// the cache and must be closed
+func ReadResponse(c Cache, key string, req *http.Request) (*http.Response, error) {
+	stream, err := c.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	resp.Body = &streamBody{ReadCloser: resp.Body, stream: stream}
+
+	return resp, nil
+}
+
+// hookName returns a name for a hook for logging and metrics
+func hookName(h Hook) string {
+	if s, ok := h.(fmt.Stringer); ok {
+		return s.String()
+	}
+
+	return fmt.Sprintf("%T", h)
+}
+
+// matching returns the hooks that match a request
+func (r *roundTripper) matching(req *http.Request) []Hook {
+	hooks := []Hook{}
+	if req.Method == "HEAD" {
+		return hooks
+	}
+
+	for _, h := range r.hooks {
+		if h.Match(req) {
+			hooks = append(hooks, h)
+		}
+	}
+
+	return hooks
+}
+
+// hookCheck is a check and the hook it came from
+type hookCheck struct {
+	Check
+	hook Hook
+}
+
+// checks returns the checks of hooks for a request
+func checks(hooks []Hook, req *http.Request) []hookCheck {
+	checks := []hookCheck{}
+	for _, h := range hooks {
+		if v, ok := h.(Verifier); ok {
+			if c := v.Check(req); c != nil {
+				checks = append(checks, hookCheck{c, h})
+			}
+		}
+	}
+
+	return checks
+}
+
+// verify runs checks over a body that's already been written to them, a
+// failure is logged and counted and returned
+func verify(checks []hookCheck, req *http.Request) error {
+	for _, c := range checks {
+		if err := c.Verify(); err != nil {
+			log.Printf("%s failed %s verification: %s", CanonicalUrl(req), hookName(c.hook), err.Error())
+			metrics.VerifyFailures.WithLabelValues(hookName(c.hook)).Inc()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyingBody writes a body to checks as it's read, and fails the last
+// read if they don't pass
+type verifyingBody struct {
+	io.Reader
+	io.Closer
+	req      *http.Request
+	checks   []hookCheck
+	failed   func()
+	verified bool
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	for _, c := range b.checks {
+		c.Write(p[:n])
+	}
+
+	if err == io.EOF && !b.verified {
+		b.verified = true
+		if verr := verify(b.checks, b.req); verr != nil {
+			b.failed()
+			return n, verr
+		}
+	}
+
+	return n, err
+}
+
+// find asks the finders of hooks for a response
+func find(hooks []Hook, req *http.Request) (*http.Response, error) {
+	for _, h := range hooks {
+		if f, ok := h.(Finder); ok {
+			if resp, err := f.Find(req); err != nil || resp != nil {
+				return resp, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// alias asks the aliasers of hooks for another request to answer req with
+func alias(hooks []Hook, req *http.Request) *http.Request {
+	for _, h := range hooks {
+		if a, ok := h.(Aliaser); ok {
+			if aliased := a.Alias(req); aliased != nil {
+				return aliased
+			}
+		}
+	}
+
+	return nil
+}
+
+// stored tells the indexers of hooks a response has been stored
+func stored(hooks []Hook, req *http.Request, key string) {
+	for _, h := range hooks {
+		if i, ok := h.(Indexer); ok {
+			i.Stored(req, key)
+		}
+	}
+}
+
+// preload returns whether any of hooks want a response stored before it's
+// served
+func preload(hooks []Hook, req *http.Request) bool {
+	for _, h := range hooks {
+		if p, ok := h.(Preloader); ok && p.Preload(req) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,18 +1,28 @@
 package cache
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"strings"
+	"sync"
 	"time"
+
+	"github.com/lox/package-proxy/accesslog"
+	"github.com/lox/package-proxy/metrics"
+	"github.com/lox/package-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("cache")
+
 const (
 	MaxAgeHeader       = "X-Package-Proxy-MaxAge"
 	CacheHeader        = "X-Cache"
@@ -21,11 +31,12 @@ const (
 )
 
 // CachedRoundTripper either uses a cache for serving a response, or the provided upstream
-func CachedRoundTripper(c Cache, upstream http.RoundTripper, serverId string) *roundTripper {
+func CachedRoundTripper(c Cache, upstream http.RoundTripper, serverId string, hooks ...Hook) *roundTripper {
 	return &roundTripper{
 		upstream: upstream,
 		cache:    c,
 		serverId: serverId,
+		hooks:    hooks,
 	}
 }
 
@@ -34,37 +45,70 @@ type roundTripper struct {
 	upstream http.RoundTripper
 	cache    Cache
 	serverId string
+	hooks    []Hook
+	writes   sync.WaitGroup
 }
 
 func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "cache.RoundTrip")
+	defer span.End()
+
 	key := cacheKey(req)
+	span.SetAttributes(attribute.String("cache.key", key))
+	hooks := r.matching(req)
 
-	if isRequestCacheable(req) && r.cache.Has(key) {
-		stream, err := r.cache.Read(key)
-		if err != nil {
-			return nil, err
+	if isRequestCacheable(req) {
+		if aliased := alias(hooks, req); aliased != nil {
+			span.SetAttributes(attribute.String("cache.alias", CanonicalUrl(aliased)))
+			return r.RoundTrip(aliased)
 		}
 
-		defer stream.Close()
-		resp, err := http.ReadResponse(bufio.NewReader(stream), req)
-		if err != nil {
+		resp, err := r.lookup(ctx, req, key, hooks)
+		if err != nil || resp != nil {
 			return resp, err
 		}
-
-		return r.cacheHit(resp)
 	}
 
-	upstreamResp, err := r.upstream.RoundTrip(req)
+	upstreamResp, err := r.fetch(ctx, req)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return upstreamResp, err
 	}
 
-	if isRequestCacheable(req) && isResponseCacheable(upstreamResp) {
+	if isRequestStorable(req) && isResponseCacheable(upstreamResp) {
 		respCopy, err := copyResponse(upstreamResp)
 		if err != nil {
 			return nil, err
 		}
-		go r.storeResponse(key, respCopy)
+		if checks := checks(hooks, req); len(checks) > 0 {
+			body, _ := bufferBody(respCopy)
+			for _, c := range checks {
+				c.Write(body)
+			}
+			if err := verify(checks, req); IsStale(err) {
+				return r.cacheSkip(upstreamResp)
+			} else if err != nil {
+				return nil, fmt.Errorf("%s failed verification: %s", CanonicalUrl(req), err.Error())
+			}
+		}
+		store := func() {
+			if err := r.storeResponse(ctx, key, respCopy); err != nil {
+				log.Printf("error storing %s: %s", respCopy.Request.URL, err.Error())
+			} else {
+				stored(hooks, respCopy.Request, key)
+			}
+		}
+
+		if preload(hooks, req) {
+			store()
+		} else {
+			r.writes.Add(1)
+			go func() {
+				defer r.writes.Done()
+				store()
+			}()
+		}
 	} else {
 		return r.cacheSkip(upstreamResp)
 	}
@@ -72,6 +116,106 @@ func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	return r.cacheMiss(upstreamResp)
 }
 
+// lookup returns a response from the cache, or nil if there isn't one.
+// Hooks can find responses for requests that aren't cached.
+func (r *roundTripper) lookup(ctx context.Context, req *http.Request, key string, hooks []Hook) (*http.Response, error) {
+	_, span := tracer.Start(ctx, "cache.lookup")
+	defer span.End()
+
+	if r.cache.Has(key) {
+		resp, err := r.read(req, key, hooks)
+		if err != nil || resp != nil {
+			span.SetAttributes(attribute.Bool("cache.hit", resp != nil))
+			return resp, err
+		}
+	}
+
+	resp, err := find(hooks, req)
+	if err != nil || resp == nil {
+		span.SetAttributes(attribute.Bool("cache.hit", false))
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Bool("cache.hit", true))
+	return r.cacheHit(resp)
+}
+
+// read returns a cached response with its body streamed from the cache.
+// Hooks check the body as it's read, and if it fails the last read fails and
+// the entry is evicted.
+func (r *roundTripper) read(req *http.Request, key string, hooks []Hook) (*http.Response, error) {
+	resp, err := ReadResponse(r.cache, key, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if checks := checks(hooks, req); len(checks) > 0 {
+		resp.Body = &verifyingBody{
+			Reader: resp.Body,
+			Closer: resp.Body,
+			req:    req,
+			checks: checks,
+			failed: func() {
+				if err := r.cache.Delete(key); err != nil && err != ErrNotFound {
+					log.Printf("error evicting %s: %s", CanonicalUrl(req), err.Error())
+				}
+			},
+		}
+	}
+
+	return r.cacheHit(resp)
+}
+
+// streamBody closes the cache stream a response body is read from
+type streamBody struct {
+	io.ReadCloser
+	stream io.Closer
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stream.Close()
+	return err
+}
+
+// fetch sends a request to the upstream server
+func (r *roundTripper) fetch(ctx context.Context, req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(ctx, "upstream.fetch",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.full", req.URL.String()),
+		),
+	)
+	defer span.End()
+
+	upstreamReq := req.Clone(ctx)
+	tracing.Inject(ctx, upstreamReq)
+
+	start := time.Now()
+	resp, err := r.upstream.RoundTrip(upstreamReq)
+	metrics.UpstreamDuration.WithLabelValues(patternLabel(req)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+
+	return resp, err
+}
+
+// patternLabel returns the cache pattern a request matched for metrics, or
+// none
+func patternLabel(req *http.Request) string {
+	if e := accesslog.FromContext(req.Context()); e != nil && e.Rule != "" {
+		return e.Rule
+	}
+
+	return "none"
+}
+
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html#sec13.5.1
 var ignoredHeaders = []string{
 	"Connection",
@@ -88,7 +232,10 @@ var ignoredHeaders = []string{
 }
 
 // storeResponse writes a response to the cache
-func (r *roundTripper) storeResponse(key string, resp *http.Response) error {
+func (r *roundTripper) storeResponse(ctx context.Context, key string, resp *http.Response) error {
+	_, span := tracer.Start(ctx, "cache.store")
+	defer span.End()
+
 	for _, h := range ignoredHeaders {
 		resp.Header.Del(h)
 	}
@@ -101,16 +248,32 @@ func (r *roundTripper) storeResponse(key string, resp *http.Response) error {
 
 	// TODO: check Response Cache-Control headers
 	if header := resp.Request.Header.Get(MaxAgeHeader); header != "" {
-		if maxAge, err := time.ParseDuration(header); err != nil {
-			r.cache.Write(key, bytes.NewReader(b), maxAge)
-		} else {
+		maxAge, err := time.ParseDuration(header)
+		if err != nil {
 			return err
 		}
+		return r.cache.Write(key, CanonicalUrl(resp.Request), bytes.NewReader(b), maxAge)
 	}
 
 	return nil
 }
 
+// Wait blocks until in-flight cache writes finish or the context is done
+func (r *roundTripper) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.writes.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (r *roundTripper) setProxyHeaders(resp *http.Response) {
 	via := fmt.Sprintf("%s %s", resp.Proto, r.serverId)
 
@@ -126,7 +289,8 @@ func (r *roundTripper) setProxyHeaders(resp *http.Response) {
 }
 
 func copyResponse(resp *http.Response) (*http.Response, error) {
-	resp2 := *resp // shallow copy is ok
+	resp2 := *resp // shallow copy is ok, apart from headers which are changed
+	resp2.Header = resp.Header.Clone()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -140,6 +304,15 @@ func copyResponse(resp *http.Response) (*http.Response, error) {
 	return &resp2, nil
 }
 
+// bufferBody reads a response body into memory, replacing it so it can be
+// read again
+func bufferBody(resp *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
 func (r *roundTripper) cacheHit(resp *http.Response) (*http.Response, error) {
 	// set an Age header
 	if t, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
@@ -149,21 +322,18 @@ func (r *roundTripper) cacheHit(resp *http.Response) (*http.Response, error) {
 
 	r.setProxyHeaders(resp)
 	resp.Header.Set(CacheHeader, "HIT from "+r.serverId)
-	logResponse(resp)
 	return resp, nil
 }
 
 func (r *roundTripper) cacheMiss(resp *http.Response) (*http.Response, error) {
 	r.setProxyHeaders(resp)
 	resp.Header.Set(CacheHeader, "MISS from "+r.serverId)
-	logResponse(resp)
 	return resp, nil
 }
 
 func (r *roundTripper) cacheSkip(resp *http.Response) (*http.Response, error) {
 	r.setProxyHeaders(resp)
 	resp.Header.Set(CacheHeader, "SKIP from "+r.serverId)
-	logResponse(resp)
 	return resp, nil
 }
 
@@ -175,41 +345,33 @@ func isRequestCacheable(req *http.Request) bool {
 	return req.Method == "GET" || req.Method == "HEAD"
 }
 
+// isRequestStorable returns whether the response to a request can be stored.
+// HEAD responses have no body, so they're answered from the cache but never
+// stored under the key a GET would use.
+func isRequestStorable(req *http.Request) bool {
+	return isRequestCacheable(req) && req.Method == "GET"
+}
+
 func isResponseCacheable(resp *http.Response) bool {
 	return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusFound
 }
 
+// Key returns the MD5 cache key for a url
+func Key(url string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(url)))
+}
+
 // cacheKey returns an MD5 cache key for a request
 func cacheKey(req *http.Request) string {
-	url := req.URL.String()
+	return Key(CanonicalUrl(req))
+}
 
+// CanonicalUrl returns the url a request was made for before any rewriting
+func CanonicalUrl(req *http.Request) string {
 	// canonical url is set upstream pre-rewrite
 	if h := req.Header.Get(CanonicalUrlHeader); h != "" {
-		url = h
+		return h
 	}
 
-	return fmt.Sprintf("%x", md5.Sum([]byte(url)))
-}
-
-func logResponse(resp *http.Response) {
-	status := resp.Header.Get(CacheHeader)
-
-	if strings.HasPrefix(status, "HIT") {
-		status = "\x1b[32;1mHIT\x1b[0m"
-	} else if strings.HasPrefix(status, "MISS") {
-		status = "\x1b[31;1mMISS\x1b[0m"
-	} else {
-		status = "\x1b[33;1mSKIP\x1b[0m"
-	}
-
-	log.Printf(
-		"%s \"%s %s %s\" (%s) %d %s",
-		resp.Request.RemoteAddr,
-		resp.Request.Method,
-		resp.Request.URL,
-		resp.Request.Proto,
-		resp.Status,
-		resp.ContentLength,
-		status,
-	)
+	return req.URL.String()
 }
@@ -4,33 +4,53 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"sync"
 	"time"
 )
 
 func NewMapCache() *mapCache {
-	return &mapCache{map[string][]byte{}}
+	return &mapCache{Map: map[string][]byte{}, entries: map[string]Entry{}}
 }
 
 type mapCache struct {
-	Map map[string][]byte
+	Map     map[string][]byte
+	entries map[string]Entry
+	mutex   sync.RWMutex
 }
 
-func (m *mapCache) Write(key string, r io.Reader, maxAge time.Duration) error {
+func (m *mapCache) Write(key, url string, r io.Reader, maxAge time.Duration) error {
 	buffer := bytes.Buffer{}
 	_, err := buffer.ReadFrom(r)
 	if err != nil {
 		return err
 	}
 
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	m.Map[key] = buffer.Bytes()
+	m.entries[key] = Entry{
+		Key:      key,
+		URL:      url,
+		Size:     int64(buffer.Len()),
+		StoredAt: time.Now(),
+		MaxAge:   maxAge,
+	}
 	return nil
 }
 
 func (m *mapCache) Read(key string) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	var buffer *bytes.Buffer
 
 	if b, ok := m.Map[key]; ok {
 		buffer = bytes.NewBuffer(b)
+		if e, ok := m.entries[key]; ok {
+			e.Hits++
+			m.entries[key] = e
+		}
 	} else {
 		buffer = &bytes.Buffer{}
 	}
@@ -39,6 +59,66 @@ func (m *mapCache) Read(key string) (io.ReadCloser, error) {
 }
 
 func (m *mapCache) Has(key string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	_, ok := m.Map[key]
 	return ok
 }
+
+func (m *mapCache) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.Map[key]; !ok {
+		return ErrNotFound
+	}
+
+	delete(m.Map, key)
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *mapCache) Stat(key string) (Entry, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if _, ok := m.Map[key]; !ok {
+		return Entry{}, ErrNotFound
+	}
+
+	return m.entries[key], nil
+}
+
+func (m *mapCache) Each(fn func(e Entry)) {
+	m.mutex.RLock()
+	entries := make([]Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+	m.mutex.RUnlock()
+
+	for _, e := range entries {
+		fn(e)
+	}
+}
+
+func (m *mapCache) Expire() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	expired := 0
+	for key, e := range m.entries {
+		if e.TTL() <= 0 {
+			delete(m.Map, key)
+			delete(m.entries, key)
+			expired++
+		}
+	}
+
+	return expired
+}
+
+func (m *mapCache) Close() error {
+	return nil
+}
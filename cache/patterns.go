@@ -6,19 +6,20 @@ import (
 )
 
 // NewPattern creates a new cache pattern, panics on parse error
-func NewPattern(pattern string, d time.Duration) *cachePattern {
-	return &cachePattern{Regexp: regexp.MustCompile(pattern), Duration: d}
+func NewPattern(pattern string, d time.Duration) *CachePattern {
+	return &CachePattern{Regexp: regexp.MustCompile(pattern), Duration: d}
 }
 
-type cachePattern struct {
+// CachePattern is a url regexp and how long matching responses are cached for
+type CachePattern struct {
 	*regexp.Regexp
 	Duration time.Duration
 }
 
-type CachePatternSlice []*cachePattern
+type CachePatternSlice []*CachePattern
 
 // MatchString tries to match a given string across all patterns
-func (r CachePatternSlice) MatchString(subject string) (bool, *cachePattern) {
+func (r CachePatternSlice) MatchString(subject string) (bool, *CachePattern) {
 	for _, p := range r {
 		if p.MatchString(subject) {
 			return true, p
@@ -0,0 +1,159 @@
+package debian
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lox/package-proxy/mirror"
+)
+
+const (
+	debianMirror   = "http://deb.debian.org/debian/"
+	securityMirror = "http://deb.debian.org/debian-security/"
+	archiveMirror  = "http://archive.debian.org/"
+)
+
+// Config lists the mirrors debian requests are rewritten to, in order of
+// preference. Empty lists use deb.debian.org and archive.debian.org.
+type Config struct {
+	Mirrors         []string
+	SecurityMirrors []string
+	ArchiveMirrors  []string
+
+	// Client is used for health checks
+	Client *http.Client
+
+	// HealthInterval is how often mirrors are checked
+	HealthInterval time.Duration
+}
+
+// debianRewriter rewrites the debian archives, the security archive and
+// archive.debian.org to their own groups of mirrors
+type debianRewriter struct {
+	groups []*mirror.Group
+}
+
+// NewRewriter rewrites requests for debian's archives to the first healthy
+// mirror configured for them. Files under pool/ are cached once under
+// deb.debian.org, whichever host or mirror they were requested from.
+func NewRewriter(config Config) (*debianRewriter, error) {
+	d := &debianRewriter{}
+
+	for _, gc := range []mirror.Config{
+		{
+			Name: "debian",
+			Origins: []mirror.Origin{
+				{Host: "deb.debian.org", Path: "/debian/"},
+				{Host: "ftp.debian.org", Path: "/debian/"},
+				{Host: "ftp.*.debian.org", Path: "/debian/"},
+				{Host: "http.debian.net", Path: "/debian/"},
+			},
+			Mirrors:        defaultTo(config.Mirrors, debianMirror),
+			HealthPath:     "dists/stable/InRelease",
+			Canonical:      mustParse(debianMirror),
+			CanonicalPaths: []string{"pool/"},
+		},
+		{
+			Name: "debian-security",
+			Origins: []mirror.Origin{
+				{Host: "security.debian.org", Path: "/debian-security/"},
+				{Host: "deb.debian.org", Path: "/debian-security/"},
+				// sources from before bullseye leave out the path
+				{Host: "security.debian.org", Path: "/"},
+			},
+			Mirrors:        defaultTo(config.SecurityMirrors, securityMirror),
+			HealthPath:     "dists/stable-security/InRelease",
+			Canonical:      mustParse(securityMirror),
+			CanonicalPaths: []string{"pool/"},
+		},
+		{
+			Name:    "debian-archive",
+			Origins: []mirror.Origin{{Host: "archive.debian.org", Path: "/"}},
+			Mirrors: defaultTo(config.ArchiveMirrors, archiveMirror),
+		},
+	} {
+		gc.Strategy = mirror.Ordered
+		gc.Client = config.Client
+		gc.HealthInterval = config.HealthInterval
+
+		g, err := mirror.NewGroup(gc)
+		if err != nil {
+			return nil, err
+		}
+		d.groups = append(d.groups, g)
+	}
+
+	return d, nil
+}
+
+func defaultTo(mirrors []string, mirror string) []string {
+	if len(mirrors) == 0 {
+		return []string{mirror}
+	}
+	return mirrors
+}
+
+func mustParse(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// Start health checks the mirrors in the background
+func (d *debianRewriter) Start() {
+	for _, g := range d.groups {
+		g.Start()
+	}
+}
+
+func (d *debianRewriter) String() string {
+	return "debian"
+}
+
+func (d *debianRewriter) Rewrite(r *http.Request) {
+	for _, g := range d.groups {
+		before := r.URL.String()
+		if g.Rewrite(r); r.URL.String() != before {
+			return
+		}
+	}
+}
+
+func (d *debianRewriter) Canonical(u *url.URL) (string, bool) {
+	for _, g := range d.groups {
+		if c, ok := g.Canonical(u); ok {
+			return c, true
+		}
+	}
+
+	return "", false
+}
+
+func (d *debianRewriter) Failover(req *http.Request, original *url.URL, resp *http.Response, err error) *url.URL {
+	for _, g := range d.groups {
+		if next := g.Failover(req, original, resp, err); next != nil {
+			return next
+		}
+	}
+
+	return nil
+}
+
+func (d *debianRewriter) Observe(req *http.Request, bytes int64, duration time.Duration, err error) {
+	for _, g := range d.groups {
+		g.Observe(req, bytes, duration, err)
+	}
+}
+
+// MirrorStats returns the stats of the mirrors of every group
+func (d *debianRewriter) MirrorStats() []mirror.MirrorStats {
+	stats := []mirror.MirrorStats{}
+	for _, g := range d.groups {
+		stats = append(stats, g.MirrorStats()...)
+	}
+
+	return stats
+}
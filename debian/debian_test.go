@@ -0,0 +1,57 @@
+package debian
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRewritesDebianHosts(t *testing.T) {
+	d, err := NewRewriter(Config{
+		Mirrors:         []string{"http://mirror.local/debian/"},
+		SecurityMirrors: []string{"http://mirror.local/debian-security/"},
+		ArchiveMirrors:  []string{"http://mirror.local/debian-archive/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for from, to := range map[string]string{
+		"http://deb.debian.org/debian/dists/bookworm/InRelease":                        "http://mirror.local/debian/dists/bookworm/InRelease",
+		"http://ftp.au.debian.org/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb":     "http://mirror.local/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb",
+		"http://security.debian.org/debian-security/dists/bookworm-security/InRelease": "http://mirror.local/debian-security/dists/bookworm-security/InRelease",
+		"http://security.debian.org/dists/buster/updates/InRelease":                    "http://mirror.local/debian-security/dists/buster/updates/InRelease",
+		"http://archive.debian.org/debian/dists/jessie/Release":                        "http://mirror.local/debian-archive/debian/dists/jessie/Release",
+		"http://archive.ubuntu.com/ubuntu/dists/noble/InRelease":                       "http://archive.ubuntu.com/ubuntu/dists/noble/InRelease",
+	} {
+		req, _ := http.NewRequest("GET", from, nil)
+		d.Rewrite(req)
+
+		if req.URL.String() != to {
+			t.Errorf("Expected %s to be rewritten to %s, got %s", from, to, req.URL)
+		}
+	}
+}
+
+func TestPoolFilesHaveOneCanonicalUrl(t *testing.T) {
+	d, err := NewRewriter(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for from, to := range map[string]string{
+		"http://ftp.au.debian.org/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb":                    "http://deb.debian.org/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb",
+		"https://deb.debian.org/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb":                      "http://deb.debian.org/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb",
+		"http://security.debian.org/pool/updates/main/o/openssl/libssl1.1_1.1.1n-0+deb10u6_amd64.deb": "http://deb.debian.org/debian-security/pool/updates/main/o/openssl/libssl1.1_1.1.1n-0+deb10u6_amd64.deb",
+	} {
+		u, _ := url.Parse(from)
+		if c, ok := d.Canonical(u); !ok || c != to {
+			t.Errorf("Expected %s to be cached as %s, got %s", from, to, c)
+		}
+	}
+
+	u, _ := url.Parse("http://ftp.au.debian.org/debian/dists/bookworm/InRelease")
+	if c, ok := d.Canonical(u); ok {
+		t.Errorf("Expected indexes to keep their own url, got %s", c)
+	}
+}
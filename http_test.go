@@ -2,15 +2,26 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/lox/package-proxy/apt"
 	"github.com/lox/package-proxy/cache"
+	"github.com/lox/package-proxy/debian"
+	"github.com/lox/package-proxy/metrics"
+	"github.com/lox/package-proxy/mirror"
 	"github.com/lox/package-proxy/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type testFixture struct {
@@ -67,6 +78,17 @@ func assertHeader(t *testing.T, r *http.Response, header string, expected string
 	}
 }
 
+// waitForCached waits for a response to url to be written to the cache in
+// the background
+func waitForCached(t *testing.T, c cache.Cache, url string) {
+	for deadline := time.Now().Add(time.Second); !c.Has(cache.Key(url)); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be cached", url)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
 func TestProxyCachesRequests(t *testing.T) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Llamas rock"))
@@ -95,6 +117,121 @@ func TestProxyCachesRequests(t *testing.T) {
 	assertHeader(t, resp2, cache.CacheHeader, "HIT")
 }
 
+func TestProxyWritesCacheableResponses(t *testing.T) {
+	var requests int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("Llamas rock"))
+	}
+	c := cache.NewMapCache()
+	fixture := newTestFixture(handler, &server.Config{
+		Cache:    c,
+		Patterns: cache.CachePatternSlice{cache.NewPattern(".", time.Hour*100)},
+	})
+	defer fixture.close()
+
+	u := "http://example.org/llamas"
+	for _, expected := range []string{"MISS", "HIT"} {
+		resp, err := fixture.client().Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "Llamas rock" {
+			t.Fatalf("Unexpected body %q", body)
+		} else if !strings.HasPrefix(resp.Header.Get(cache.CacheHeader), expected) {
+			t.Fatalf("Expected a %s, got %s", expected, resp.Header.Get(cache.CacheHeader))
+		}
+		waitForCached(t, c, u)
+	}
+
+	if e, err := c.Stat(cache.Key(u)); err != nil {
+		t.Fatal(err)
+	} else if e.MaxAge != time.Hour*100 {
+		t.Fatalf("Expected the pattern's max age, got %s", e.MaxAge)
+	} else if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected one upstream request, got %d", n)
+	}
+}
+
+func TestProxyDoesNotCacheHeadRequests(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Llamas rock"))
+	}
+	c := cache.NewMapCache()
+	fixture := newTestFixture(handler, &server.Config{
+		Cache:    c,
+		Patterns: cache.CachePatternSlice{cache.NewPattern(".", time.Hour*100)},
+	})
+	defer fixture.close()
+
+	u := "http://example.org/llamas"
+	resp, err := fixture.client().Head(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertHeader(t, resp, cache.CacheHeader, "SKIP from package-proxy")
+
+	time.Sleep(time.Millisecond * 50)
+	if c.Has(cache.Key(u)) {
+		t.Fatal("Expected a HEAD response not to be cached")
+	}
+
+	resp, err = fixture.client().Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "Llamas rock" {
+		t.Fatalf("Expected the full body after a HEAD, got %q %v", body, err)
+	}
+
+	waitForCached(t, c, u)
+	resp, err = fixture.client().Head(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertHeader(t, resp, cache.CacheHeader, "HIT from package-proxy")
+}
+
+func TestUpstreamDurationIsLabelledByPattern(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Llamas rock"))
+	}
+	fixture := newTestFixture(handler, &server.Config{
+		Patterns: cache.CachePatternSlice{cache.NewPattern(`llamas$`, time.Hour)},
+	})
+	defer fixture.close()
+
+	get := func(u string) {
+		resp, err := fixture.client().Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	get("http://example.org/llamas")
+	series := testutil.CollectAndCount(metrics.UpstreamDuration)
+
+	// clients choose the host, so it mustn't add series
+	for _, host := range []string{"example.net", "example.com", "llamas.example.org"} {
+		get("http://" + host + "/llamas")
+	}
+
+	if n := testutil.CollectAndCount(metrics.UpstreamDuration); n != series {
+		t.Fatalf("Expected %d series after requests to other hosts, got %d", series, n)
+	} else if !metrics.UpstreamDuration.DeleteLabelValues("llamas$") {
+		t.Fatal("Expected upstream durations to be labelled with the pattern")
+	}
+}
+
 func TestRewritesApply(t *testing.T) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Llamas rock"))
@@ -123,3 +260,647 @@ func TestRewritesApply(t *testing.T) {
 		t.Fatalf("Response content was incorrect, rewrites not applying?")
 	}
 }
+
+func TestPurgeEvictsCachedUrl(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Llamas rock"))
+	}
+	c := cache.NewMapCache()
+	fixture := newTestFixture(handler, &server.Config{Cache: c})
+	defer fixture.close()
+
+	u := "http://registry.npmjs.org/left-pad"
+	c.Write(cache.Key(u), u, bytes.NewReader([]byte("stale")), time.Hour)
+
+	req, err := http.NewRequest("PURGE", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp1, err := fixture.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp1.StatusCode != http.StatusOK {
+		t.Fatalf("Expected purge to return 200, got %d", resp1.StatusCode)
+	}
+
+	if c.Has(cache.Key(u)) {
+		t.Fatalf("Expected %s to be evicted from the cache", u)
+	}
+
+	resp2, err := fixture.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp2.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected second purge to return 404, got %d", resp2.StatusCode)
+	}
+}
+
+func TestPurgeRequiresAllowedNetwork(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	nets, err := server.ParseNets([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := newTestFixture(handler, &server.Config{PurgeAllowed: nets})
+	defer fixture.close()
+
+	req, err := http.NewRequest("PURGE", "http://registry.npmjs.org/left-pad", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := fixture.client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected purge to return 403, got %d", resp.StatusCode)
+	}
+}
+
+type failoverRewriter struct {
+	primary, secondary *url.URL
+}
+
+func (f *failoverRewriter) Rewrite(req *http.Request) {
+	req.URL.Host = f.primary.Host
+}
+
+func (f *failoverRewriter) Failover(req *http.Request, original *url.URL, resp *http.Response, err error) *url.URL {
+	if req.URL.Host != f.primary.Host {
+		return nil
+	}
+
+	u := *req.URL
+	u.Host = f.secondary.Host
+	return &u
+}
+
+func TestFailoverRetriesFailedRequests(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("llamas"))
+	}))
+	defer secondary.Close()
+
+	primaryUrl, _ := url.Parse(primary.URL)
+	secondaryUrl, _ := url.Parse(secondary.URL)
+
+	pp, err := server.NewPackageProxy(&server.Config{
+		Cache:     cache.NewMapCache(),
+		Rewriters: []server.Rewriter{&failoverRewriter{primaryUrl, secondaryUrl}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(pp)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Get("http://example.org/llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "llamas" {
+		t.Fatalf("Expected the secondary to respond, got %d %q", resp.StatusCode, body)
+	}
+}
+
+type observingRewriter struct {
+	observed chan int64
+}
+
+func (o *observingRewriter) Rewrite(req *http.Request) {}
+
+func (o *observingRewriter) Observe(req *http.Request, bytes int64, duration time.Duration, err error) {
+	o.observed <- bytes
+}
+
+func TestObserversSeeUpstreamRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("llamas"))
+	}))
+	defer backend.Close()
+
+	observer := &observingRewriter{observed: make(chan int64, 1)}
+	pp, err := server.NewPackageProxy(&server.Config{
+		Cache:     cache.NewMapCache(),
+		Rewriters: []server.Rewriter{observer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(pp)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Get(backend.URL + "/llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	select {
+	case n := <-observer.observed:
+		if n != 6 {
+			t.Fatalf("Expected 6 bytes to be observed, got %d", n)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected the upstream request to be observed")
+	}
+}
+
+func TestMirrorGroupsShareCacheEntries(t *testing.T) {
+	mirrorA := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("from a"))
+	}))
+	defer mirrorA.Close()
+
+	mirrorB := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("from b"))
+	}))
+	defer mirrorB.Close()
+
+	origin, _ := mirror.ParseOrigin("http://registry.npmjs.org/")
+	group, err := mirror.NewGroup(mirror.Config{
+		Name:     "npm",
+		Origins:  []mirror.Origin{origin},
+		Mirrors:  []string{mirrorA.URL},
+		Strategy: mirror.Ordered,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cache.NewMapCache()
+	pp, err := server.NewPackageProxy(&server.Config{
+		Cache:     c,
+		Rewriters: []server.Rewriter{group},
+		Patterns:  cache.CachePatternSlice{cache.NewPattern(".", time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(pp)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	get := func() string {
+		resp, err := client.Get("http://registry.npmjs.org/left-pad")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := get(); body != "from a" {
+		t.Fatalf("Expected the first mirror, got %q", body)
+	}
+
+	// entries are stored under the origin's url, so they're served whichever
+	// mirror is in use
+	group.SetMirrors(mirrorB.URL)
+	waitForCached(t, c, "http://registry.npmjs.org/left-pad")
+
+	if body := get(); body != "from a" {
+		t.Fatalf("Expected the cached response, got %q", body)
+	}
+}
+
+func TestCanonicalUrlsShareCacheEntries(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Write([]byte("bash"))
+	}))
+	defer backend.Close()
+
+	d, err := debian.NewRewriter(debian.Config{Mirrors: []string{backend.URL + "/debian/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cache.NewMapCache()
+	pp, err := server.NewPackageProxy(&server.Config{
+		Cache:     c,
+		Rewriters: []server.Rewriter{d},
+		Patterns:  cache.CachePatternSlice{cache.NewPattern("deb$", time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(pp)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	get := func(u string) {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	get("http://ftp.au.debian.org/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb")
+	waitForCached(t, c, "http://deb.debian.org/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb")
+
+	get("http://ftp.us.debian.org/debian/pool/main/b/bash/bash_5.2.15-2_amd64.deb")
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected one upstream request, got %d", n)
+	}
+}
+
+func TestCacheHooksRejectCorruptResponses(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("corrupted"))
+	}
+	c := cache.NewMapCache()
+	fixture := newTestFixture(handler, &server.Config{
+		Cache:      c,
+		Patterns:   cache.CachePatternSlice{cache.NewPattern(".", time.Hour)},
+		CacheHooks: []cache.Hook{apt.NewByHash(c)},
+	})
+	defer fixture.close()
+
+	sum := sha256.Sum256([]byte("Package: bash\n"))
+	u := "http://archive.ubuntu.com/ubuntu/dists/noble/main/binary-amd64/by-hash/SHA256/" + hex.EncodeToString(sum[:])
+
+	resp, err := fixture.client().Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected a corrupt response to be rejected, got %d", resp.StatusCode)
+	}
+
+	if c.Has(cache.Key(u)) {
+		t.Fatal("Expected a corrupt response not to be cached")
+	}
+}
+
+func TestPathStyleRequestsShareCacheEntries(t *testing.T) {
+	var requests int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("bash"))
+	}
+	c := cache.NewMapCache()
+	fixture := newTestFixture(handler, &server.Config{
+		Cache:     c,
+		Patterns:  cache.CachePatternSlice{cache.NewPattern("deb$", time.Hour)},
+		PathHosts: []string{"archive.ubuntu.com"},
+	})
+	defer fixture.close()
+
+	u := "http://archive.ubuntu.com/ubuntu/pool/main/b/bash/bash_5.2_amd64.deb"
+	resp, err := http.Get(fixture.proxy.URL + "/archive.ubuntu.com/ubuntu/pool/main/b/bash/bash_5.2_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	waitForCached(t, c, u)
+
+	resp, err = fixture.client().Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected one upstream request, got %d", n)
+	}
+
+	for _, host := range []string{"example.com", "archive.ubuntu.com:22"} {
+		resp, err = http.Get(fixture.proxy.URL + "/" + host + "/ubuntu/pool/main/b/bash/bash_5.2_amd64.deb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected %s to be refused, got %d", host, resp.StatusCode)
+		}
+	}
+}
+
+func TestCacheHooksSkipHeadRequests(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Package: bash\n"))
+	}
+	c := cache.NewMapCache()
+	fixture := newTestFixture(handler, &server.Config{
+		Cache:      c,
+		Patterns:   cache.CachePatternSlice{cache.NewPattern(".", time.Hour)},
+		CacheHooks: []cache.Hook{apt.NewByHash(c)},
+	})
+	defer fixture.close()
+
+	sum := sha256.Sum256([]byte("Package: bash\n"))
+	u := "http://archive.ubuntu.com/ubuntu/dists/noble/main/binary-amd64/by-hash/SHA256/" + hex.EncodeToString(sum[:])
+
+	resp, err := fixture.client().Head(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a HEAD request to pass, got %d", resp.StatusCode)
+	}
+
+	resp, err = fixture.client().Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil || string(body) != "Package: bash\n" {
+		t.Fatalf("Expected the full body after a HEAD request, got %q %v", body, err)
+	}
+}
+
+// aptBackend serves an InRelease listing Packages.gz as index, and index
+// for any other path, counting those requests and the last path
+func aptBackend(index []byte, byHash bool, packages []byte, requests *int32, last *atomic.Value) http.HandlerFunc {
+	sum := sha256.Sum256(index)
+	release := fmt.Sprintf("Suite: noble\nAcquire-By-Hash: %s\nSHA256:\n %s %d main/binary-amd64/Packages.gz\n",
+		map[bool]string{true: "yes", false: "no"}[byHash], hex.EncodeToString(sum[:]), len(index))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/InRelease") {
+			w.Write([]byte(release))
+			return
+		}
+
+		atomic.AddInt32(requests, 1)
+		last.Store(r.URL.Path)
+		if strings.Contains(r.URL.Path, "/by-hash/") {
+			w.Write(index)
+		} else {
+			w.Write(packages)
+		}
+	}
+}
+
+func TestSnapshotsFetchAndCacheIndexesByHash(t *testing.T) {
+	var requests int32
+	var last atomic.Value
+	index := []byte("Package: bash\n")
+	c := cache.NewMapCache()
+	patterns := cache.CachePatternSlice{cache.NewPattern("/by-hash/", forever), cache.NewPattern(".", time.Hour)}
+	fixture := newTestFixture(aptBackend(index, true, []byte("Package: zsh\n"), &requests, &last), &server.Config{
+		Cache:      c,
+		Patterns:   patterns,
+		CacheHooks: []cache.Hook{apt.NewByHash(c), apt.NewSnapshots(c, patterns)},
+	})
+	defer fixture.close()
+
+	dists := "http://archive.ubuntu.com/ubuntu/dists/noble/"
+	resp, err := fixture.client().Get(dists + "InRelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForCached(t, c, dists+"InRelease")
+
+	sum := sha256.Sum256(index)
+	byHash := dists + "main/binary-amd64/by-hash/SHA256/" + hex.EncodeToString(sum[:])
+
+	for i, expected := range []string{"MISS", "HIT", "HIT"} {
+		resp, err := fixture.client().Get(dists + "main/binary-amd64/Packages.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if !bytes.Equal(body, index) {
+			t.Fatalf("Expected the index the release lists, got %q", body)
+		} else if !strings.HasPrefix(resp.Header.Get(cache.CacheHeader), expected) {
+			t.Fatalf("Expected request %d to be a %s, got %s", i+1, expected, resp.Header.Get(cache.CacheHeader))
+		}
+
+		if i == 0 {
+			waitForCached(t, c, byHash)
+		}
+	}
+
+	if e, err := c.Stat(cache.Key(byHash)); err != nil {
+		t.Fatal(err)
+	} else if e.MaxAge != forever {
+		t.Fatalf("Expected the by-hash index to be cached for the by-hash max age, got %s", e.MaxAge)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected one upstream request, got %d", n)
+	} else if p := last.Load().(string); !strings.HasSuffix(p, "/by-hash/SHA256/"+hex.EncodeToString(sum[:])) {
+		t.Fatalf("Expected the index to be fetched by-hash, got %s", p)
+	}
+}
+
+func TestSnapshotsServeStaleIndexesWithoutCaching(t *testing.T) {
+	var requests int32
+	var last atomic.Value
+	c := cache.NewMapCache()
+	patterns := cache.CachePatternSlice{cache.NewPattern("/by-hash/", forever), cache.NewPattern(".", time.Hour)}
+	fixture := newTestFixture(aptBackend([]byte("Package: bash\n"), false, []byte("Package: zsh\n"), &requests, &last), &server.Config{
+		Cache:      c,
+		Patterns:   patterns,
+		CacheHooks: []cache.Hook{apt.NewByHash(c), apt.NewSnapshots(c, patterns)},
+	})
+	defer fixture.close()
+
+	dists := "http://archive.ubuntu.com/ubuntu/dists/noble/"
+	resp, err := fixture.client().Get(dists + "InRelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForCached(t, c, dists+"InRelease")
+
+	resp, err = fixture.client().Get(dists + "main/binary-amd64/Packages.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "Package: zsh\n" {
+		t.Fatalf("Expected the newer index to be served, got %d %q", resp.StatusCode, body)
+	} else if !strings.HasPrefix(resp.Header.Get(cache.CacheHeader), "SKIP") {
+		t.Fatalf("Expected the newer index not to be cached, got %s", resp.Header.Get(cache.CacheHeader))
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	if c.Has(cache.Key(dists + "main/binary-amd64/Packages.gz")) {
+		t.Fatal("Expected the newer index not to be cached")
+	}
+}
+
+// corruptHook fails its checks while corrupt is set
+type corruptHook struct {
+	corrupt int32
+}
+
+func (h *corruptHook) Match(req *http.Request) bool {
+	return true
+}
+
+func (h *corruptHook) Check(req *http.Request) cache.Check {
+	return h
+}
+
+func (h *corruptHook) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (h *corruptHook) Verify() error {
+	if atomic.LoadInt32(&h.corrupt) == 1 {
+		return fmt.Errorf("corrupt")
+	}
+	return nil
+}
+
+func TestCacheHooksVerifyCachedResponsesWhileStreaming(t *testing.T) {
+	var requests int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("llamas rock"))
+	}
+	c := cache.NewMapCache()
+	hook := &corruptHook{}
+	fixture := newTestFixture(handler, &server.Config{
+		Cache:      c,
+		Patterns:   cache.CachePatternSlice{cache.NewPattern(".", time.Hour)},
+		CacheHooks: []cache.Hook{hook},
+	})
+	defer fixture.close()
+
+	u := "http://example.org/llamas"
+	resp, err := fixture.client().Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	waitForCached(t, c, u)
+
+	atomic.StoreInt32(&hook.corrupt, 1)
+	resp, err = fixture.client().Get(u)
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	if err == nil {
+		t.Fatal("Expected a corrupt cached response to fail")
+	} else if c.Has(cache.Key(u)) {
+		t.Fatal("Expected a corrupt cached response to be evicted")
+	}
+
+	atomic.StoreInt32(&hook.corrupt, 0)
+	resp, err = fixture.client().Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "llamas rock" {
+		t.Fatalf("Unexpected body %q", body)
+	} else if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("Expected the evicted response to be fetched again, got %d requests", n)
+	}
+}
+
+// slowCache is a cache with slow writes
+type slowCache struct {
+	cache.Cache
+}
+
+func (c slowCache) Write(key, url string, r io.Reader, maxAge time.Duration) error {
+	time.Sleep(time.Millisecond * 50)
+	return c.Cache.Write(key, url, r, maxAge)
+}
+
+func TestSnapshotsStoreReleasesBeforeServingThem(t *testing.T) {
+	var version int32
+	indexes := [][]byte{[]byte("Package: bash\n"), []byte("Package: zsh\n")}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		index := indexes[atomic.LoadInt32(&version)]
+		sum := sha256.Sum256(index)
+		if strings.HasSuffix(r.URL.Path, "/InRelease") {
+			fmt.Fprintf(w, "Suite: noble\nSHA256:\n %s %d main/binary-amd64/Packages.gz\n",
+				hex.EncodeToString(sum[:]), len(index))
+		} else {
+			w.Write(index)
+		}
+	}
+	c := slowCache{cache.NewMapCache()}
+	patterns := cache.CachePatternSlice{cache.NewPattern(".", time.Hour)}
+	fixture := newTestFixture(handler, &server.Config{
+		Cache:      c,
+		Patterns:   patterns,
+		CacheHooks: []cache.Hook{apt.NewByHash(c), apt.NewSnapshots(c, patterns)},
+	})
+	defer fixture.close()
+
+	dists := "http://archive.ubuntu.com/ubuntu/dists/noble/"
+	get := func(u string) []byte {
+		resp, err := fixture.client().Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return body
+	}
+
+	get(dists + "InRelease")
+	get(dists + "main/binary-amd64/Packages.gz")
+	waitForCached(t, c, dists+"main/binary-amd64/Packages.gz")
+
+	// the mirror updates and the cached release expires, the index must
+	// follow the new release as soon as it's been served
+	atomic.StoreInt32(&version, 1)
+	c.Delete(cache.Key(dists + "InRelease"))
+	get(dists + "InRelease")
+	if body := get(dists + "main/binary-amd64/Packages.gz"); !bytes.Equal(body, indexes[1]) {
+		t.Fatalf("Expected the index the new release lists, got %q", body)
+	}
+}
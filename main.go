@@ -1,45 +1,61 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/lox/package-proxy/accesslog"
+	"github.com/lox/package-proxy/admin"
+	"github.com/lox/package-proxy/apt"
 	"github.com/lox/package-proxy/cache"
+	"github.com/lox/package-proxy/debian"
+	"github.com/lox/package-proxy/metrics"
+	"github.com/lox/package-proxy/mirror"
 	"github.com/lox/package-proxy/mitm"
 	"github.com/lox/package-proxy/server"
+	"github.com/lox/package-proxy/setup"
+	"github.com/lox/package-proxy/tracing"
+	"github.com/lox/package-proxy/transparent"
 	"github.com/lox/package-proxy/ubuntu"
+	"github.com/lox/package-proxy/upstream"
 	"github.com/nu7hatch/gouuid"
 )
 
 const (
-	listen    = "0.0.0.0:3142"
 	day       = time.Hour * 24
 	week      = day * 7
 	forever   = day * 1000
 	cacheSize = 10 << 20 // 10Gb
-	caKey     = "certs/packageproxy-ca.key"
-	caCert    = "certs/packageproxy-ca.crt"
 )
 
 var version string
 
 var cachePatterns = cache.CachePatternSlice{
 	// aptitude / ubuntu / debian
+	cache.NewPattern(`/dists/.+/by-hash/(MD5Sum|SHA1|SHA256|SHA512)/[0-9a-f]+$`, forever),
 	cache.NewPattern(`deb$`, week),
 	cache.NewPattern(`udeb$`, week),
 	cache.NewPattern(`DiffIndex$`, time.Hour),
 	cache.NewPattern(`PackagesIndex$`, time.Hour),
-	cache.NewPattern(`Packages\.(bz2|gz|lzma)$`, time.Hour),
+	cache.NewPattern(`Packages\.(bz2|gz|lzma|xz)$`, time.Hour),
 	cache.NewPattern(`SourcesIndex$`, time.Hour),
-	cache.NewPattern(`Sources\.(bz2|gz|lzma)$`, time.Hour),
-	cache.NewPattern(`Release(\.gpg)?$`, time.Hour),
-	cache.NewPattern(`Translation-(en|fr)\.(gz|bz2|bzip2|lzma)$`, time.Hour),
-	cache.NewPattern(`Sources\.lzma$`, time.Hour),
+	cache.NewPattern(`Sources\.(bz2|gz|lzma|xz)$`, time.Hour),
+	cache.NewPattern(`(In)?Release(\.gpg)?$`, time.Hour),
+	cache.NewPattern(`Translation-[a-zA-Z_]+\.(gz|bz2|bzip2|lzma|xz)$`, time.Hour),
+	cache.NewPattern(`Contents-[a-z0-9]+\.(gz|xz)$`, time.Hour),
 	// composer / packagist
 	cache.NewPattern(`^https?://packagist\.org/(.+)\.json$`, time.Hour),
 	cache.NewPattern(`^https://api.github.com/repos/Seldaek/jsonlint/zipball/1.0.0`, week),
@@ -57,18 +73,52 @@ var cachePatterns = cache.CachePatternSlice{
 	cache.NewPattern(`^https?://registry.npmjs.org/`, time.Hour),
 }
 
-var mitmHosts = []string{
+var defaultMitmHosts = []string{
 	"codeload.github.com:443",
 	"registry.npmjs.org:443",
 	"api.github.com:443",
 	"packagist.org:443",
 }
 
+var defaultPathHosts = []string{
+	"archive.ubuntu.com",
+	"*.archive.ubuntu.com",
+	"security.ubuntu.com",
+	"ports.ubuntu.com",
+	"deb.debian.org",
+	"ftp.*.debian.org",
+	"security.debian.org",
+	"archive.debian.org",
+}
+
 type flags struct {
 	EnableRewrites      []string
 	EnableTlsUnwrapping bool
 	CacheDir            string
 	ShowVersion         bool
+	ShutdownTimeout     time.Duration
+	AdminListen         string
+	PurgeFrom           []string
+	PathHosts           []string
+	AccessLog           string
+	AccessLogFormat     string
+	Trace               string
+	CA                  mitm.CAConfig
+	PublicURL           string
+	MitmHosts           []string
+	TunnelIdleTimeout   time.Duration
+	TLS                 mitm.TLSConfig
+	LeafDir             string
+	UpstreamTLS         string
+	Listen              string
+	ListenTLS           string
+	ListenCert          string
+	ListenKey           string
+	Ubuntu              ubuntu.Config
+	Debian              debian.Config
+	MirrorGroups        string
+	TransparentHTTP     string
+	TransparentHTTPS    string
 }
 
 func parseFlags() flags {
@@ -77,35 +127,199 @@ func parseFlags() flags {
 		fmt.Println("\nOptions:")
 		fmt.Printf("  -dir=            The dir to store cache data in\n")
 		fmt.Printf("  -tls=true        Enable tls and dynamic certificate generation\n")
+		fmt.Printf("  -mitm-hosts=     Hosts to intercept, e.g registry.npmjs.org,*.rubygems.org\n")
+		fmt.Printf("  -tls-min-version=1.2 The minimum tls version for intercepted clients, 1.2 or 1.3\n")
+		fmt.Printf("  -tls-curves=     Curve preferences for intercepted clients, e.g X25519,P256\n")
+		fmt.Printf("  -listen=0.0.0.0:3142 Serve the proxy over plain http on addr, empty to disable\n")
+		fmt.Printf("  -listen-tls=     Serve the proxy over https on addr\n")
+		fmt.Printf("  -listen-cert=    A cert for -listen-tls, one is issued by the ca if not set\n")
+		fmt.Printf("  -listen-key=     The key for -listen-cert\n")
+		fmt.Printf("  -debian-mirrors=      Debian mirrors to use, in order of preference\n")
+		fmt.Printf("  -debian-security-mirrors= Debian security mirrors to use, in order of preference\n")
+		fmt.Printf("  -debian-archive-mirrors= archive.debian.org mirrors to use, in order of preference\n")
+		fmt.Printf("  -mirror-groups=       A json file of mirror groups to rewrite other origins to\n")
+		fmt.Printf("  -ubuntu-mirror-list=  A url or file listing candidate ubuntu mirrors\n")
+		fmt.Printf("  -ubuntu-mirrors=      Candidate ubuntu mirrors, instead of a list\n")
+		fmt.Printf("  -ubuntu-timeout=20s   How long to wait for ubuntu mirror benchmarks\n")
+		fmt.Printf("  -ubuntu-sample=3      How many ubuntu mirrors to benchmark before picking\n")
+		fmt.Printf("  -ubuntu-suite=        The ubuntu release mirrors must carry, defaults to the host's or noble\n")
+		fmt.Printf("  -ubuntu-max-lag=6h    How far ubuntu mirrors can lag the archive, negative disables\n")
+		fmt.Printf("  -ubuntu-explore=0.05  The share of requests sent to other ubuntu mirrors, negative disables\n")
+		fmt.Printf("  -ubuntu-health=1m     How often to health check ubuntu mirrors\n")
+		fmt.Printf("  -ubuntu-rebenchmark=24h How often to benchmark ubuntu mirrors again\n")
+		fmt.Printf("  -transparent-http=  Serve redirected http traffic on addr, routed by Host header\n")
+		fmt.Printf("  -transparent-https= Serve redirected tls traffic on addr, routed by server name (needs -tls)\n")
+		fmt.Printf("  -upstream-tls=   A json file of per-host tls settings for upstream connections\n")
+		fmt.Printf("  -tunnel-idle=5m  How long tunnels to other hosts can be idle\n")
+		fmt.Printf("  -ca-dir=certs    The dir to store a generated ca in\n")
+		fmt.Printf("  -leaf-dir=       Where to store generated host certificates, defaults to <ca-dir>/leaves\n")
+		fmt.Printf("  -ca-root-key=    A root key used to sign an intermediate ca constrained to -mitm-hosts\n")
+		fmt.Printf("  -ca-root-cert=   The root cert for -ca-root-key\n")
+		fmt.Printf("  -ca-key=         An existing ca key to use instead of generating one\n")
+		fmt.Printf("  -ca-cert=        An existing ca cert to use instead of generating one\n")
+		fmt.Printf("  -ca-name=        The common name of a generated ca\n")
+		fmt.Printf("  -ca-org=         The organization of a generated ca\n")
+		fmt.Printf("  -ca-validity=    How long a generated ca is valid for (defaults to 8760h)\n")
 		fmt.Printf("  -rewrite=all     Only rewrite specific services (defaults to all)\n")
+		fmt.Printf("  -access-log=-    Where to write the access log, a file path or - for stdout\n")
+		fmt.Printf("  -access-log-format=combined  Either combined or json\n")
+		fmt.Printf("  -admin=addr      Serve the admin api and /metrics on addr (e.g 127.0.0.1:3143)\n")
+		fmt.Printf("  -public-url=     How clients reach the proxy, used in setup scripts\n")
+		fmt.Printf("  -purge-from=     Networks allowed to send PURGE (defaults to loopback)\n")
+		fmt.Printf("  -path-hosts=     Hosts that can be requested path-style, like /archive.ubuntu.com/ubuntu/...\n")
+		fmt.Printf("  -shutdown=30s    How long to wait for in-flight requests on exit\n")
+		fmt.Printf("  -trace=          Send traces to an OTLP/HTTP endpoint, stdout or file:<path>\n")
 		fmt.Printf("  -version         The compiled version\n")
 	}
 
 	cacheDir := flag.String("dir", "", "The dir to store cache data in")
 	enableTls := flag.Bool("tls", false, "Enable tls and dynamic certificate generation")
+	mitmHosts := flag.String("mitm-hosts", strings.Join(defaultMitmHosts, ","), "Hosts to intercept")
+	tunnelIdle := flag.Duration("tunnel-idle", time.Minute*5, "How long tunnels to other hosts can be idle")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "The minimum tls version for intercepted clients")
+	tlsCurves := flag.String("tls-curves", "", "Curve preferences for intercepted clients")
+	caDir := flag.String("ca-dir", "certs", "The dir to store a generated ca in")
+	listen := flag.String("listen", "0.0.0.0:3142", "Serve the proxy over plain http on addr")
+	listenTls := flag.String("listen-tls", "", "Serve the proxy over https on addr")
+	listenCert := flag.String("listen-cert", "", "A cert for -listen-tls")
+	listenKey := flag.String("listen-key", "", "The key for -listen-cert")
+	debianMirrors := flag.String("debian-mirrors", "", "Debian mirrors to use, in order of preference")
+	debianSecurityMirrors := flag.String("debian-security-mirrors", "", "Debian security mirrors to use, in order of preference")
+	debianArchiveMirrors := flag.String("debian-archive-mirrors", "", "archive.debian.org mirrors to use, in order of preference")
+	mirrorGroups := flag.String("mirror-groups", "", "A json file of mirror groups to rewrite other origins to")
+	ubuntuMirrorList := flag.String("ubuntu-mirror-list", "http://mirrors.ubuntu.com/mirrors.txt", "A url or file listing candidate ubuntu mirrors")
+	ubuntuMirrors := flag.String("ubuntu-mirrors", "", "Candidate ubuntu mirrors, instead of a list")
+	ubuntuTimeout := flag.Duration("ubuntu-timeout", time.Second*20, "How long to wait for ubuntu mirror benchmarks")
+	ubuntuSample := flag.Int("ubuntu-sample", 3, "How many ubuntu mirrors to benchmark before picking")
+	ubuntuSuite := flag.String("ubuntu-suite", "", "The ubuntu release mirrors must carry, defaults to the host's or noble")
+	ubuntuMaxLag := flag.Duration("ubuntu-max-lag", time.Hour*6, "How far ubuntu mirrors can lag the archive, negative disables")
+	ubuntuExplore := flag.Float64("ubuntu-explore", 0.05, "The share of requests sent to other ubuntu mirrors, negative disables")
+	ubuntuHealth := flag.Duration("ubuntu-health", time.Minute, "How often to health check ubuntu mirrors")
+	ubuntuRebenchmark := flag.Duration("ubuntu-rebenchmark", time.Hour*24, "How often to benchmark ubuntu mirrors again")
+	transparentHttp := flag.String("transparent-http", "", "Serve redirected http traffic on addr")
+	transparentHttps := flag.String("transparent-https", "", "Serve redirected tls traffic on addr")
+	upstreamTls := flag.String("upstream-tls", "", "A json file of per-host tls settings for upstream connections")
+	leafDir := flag.String("leaf-dir", "", "Where to store generated host certificates")
+	caRootKey := flag.String("ca-root-key", "", "A root key used to sign an intermediate ca")
+	caRootCert := flag.String("ca-root-cert", "", "The root cert for -ca-root-key")
+	caKey := flag.String("ca-key", "", "An existing ca key to use instead of generating one")
+	caCert := flag.String("ca-cert", "", "An existing ca cert to use instead of generating one")
+	caName := flag.String("ca-name", "Package Proxy CA", "The common name of a generated ca")
+	caOrg := flag.String("ca-org", "Package Proxy", "The organization of a generated ca")
+	caValidity := flag.Duration("ca-validity", day*365, "How long a generated ca is valid for")
 	enableRewrites := flag.String("rewrite", "all", "Only rewrite specific services")
+	trace := flag.String("trace", "", "Send traces to an OTLP/HTTP endpoint, stdout or file:<path>")
 	showVersion := flag.Bool("version", false, "Show the compiled version")
+	accessLog := flag.String("access-log", "-", "Where to write the access log")
+	accessLogFormat := flag.String("access-log-format", "combined", "Either combined or json")
+	adminListen := flag.String("admin", "", "Serve the admin api on addr")
+	publicUrl := flag.String("public-url", "", "How clients reach the proxy, used in setup scripts")
+	purgeFrom := flag.String("purge-from", "", "Networks allowed to send PURGE")
+	pathHosts := flag.String("path-hosts", strings.Join(defaultPathHosts, ","), "Hosts that can be requested path-style")
+	shutdownTimeout := flag.Duration("shutdown", time.Second*30, "How long to wait for in-flight requests on exit")
 	flag.Parse()
 
+	minVersion, err := mitm.ParseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	curves, err := mitm.ParseCurves(splitList(*tlsCurves))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *leafDir == "" {
+		*leafDir = filepath.Join(*caDir, "leaves")
+	}
+
 	return flags{
 		EnableRewrites:      strings.Split(*enableRewrites, ","),
 		EnableTlsUnwrapping: *enableTls,
 		CacheDir:            *cacheDir,
 		ShowVersion:         *showVersion,
+		ShutdownTimeout:     *shutdownTimeout,
+		AdminListen:         *adminListen,
+		PurgeFrom:           splitList(*purgeFrom),
+		PathHosts:           splitList(*pathHosts),
+		AccessLog:           *accessLog,
+		AccessLogFormat:     *accessLogFormat,
+		Trace:               *trace,
+		PublicURL:           *publicUrl,
+		MitmHosts:           splitList(*mitmHosts),
+		TunnelIdleTimeout:   *tunnelIdle,
+		LeafDir:             *leafDir,
+		UpstreamTLS:         *upstreamTls,
+		Listen:              *listen,
+		ListenTLS:           *listenTls,
+		ListenCert:          *listenCert,
+		ListenKey:           *listenKey,
+		Ubuntu: ubuntu.Config{
+			Source:         ubuntuSource(*ubuntuMirrorList, splitList(*ubuntuMirrors)),
+			Client:         &http.Client{Timeout: *ubuntuTimeout},
+			Timeout:        *ubuntuTimeout,
+			SampleSize:     *ubuntuSample,
+			Suite:          *ubuntuSuite,
+			MaxLag:         *ubuntuMaxLag,
+			Explore:        *ubuntuExplore,
+			StateFile:      filepath.Join(*cacheDir, "ubuntu-mirror.json"),
+			HealthInterval: *ubuntuHealth,
+			Rebenchmark:    *ubuntuRebenchmark,
+		},
+		Debian: debian.Config{
+			Mirrors:         splitList(*debianMirrors),
+			SecurityMirrors: splitList(*debianSecurityMirrors),
+			ArchiveMirrors:  splitList(*debianArchiveMirrors),
+		},
+		MirrorGroups:     *mirrorGroups,
+		TransparentHTTP:  *transparentHttp,
+		TransparentHTTPS: *transparentHttps,
+		TLS: mitm.TLSConfig{
+			MinVersion:       minVersion,
+			CurvePreferences: curves,
+		},
+		CA: mitm.CAConfig{
+			Dir:      *caDir,
+			KeyFile:  *caKey,
+			CertFile: *caCert,
+			Subject: pkix.Name{
+				CommonName:   *caName,
+				Organization: []string{*caOrg},
+			},
+			Validity:     *caValidity,
+			RootKeyFile:  *caRootKey,
+			RootCertFile: *caRootCert,
+			Permitted:    splitList(*mitmHosts),
+		},
+	}
+}
+
+// splitList splits a comma separated flag, returning nil if it's empty
+func splitList(s string) []string {
+	if s == "" {
+		return nil
 	}
+
+	return strings.Split(s, ",")
 }
 
-func enableTls(handler http.Handler) (http.Handler, error) {
-	log.Printf("using ca cert %s for tls unwrapping", caCert)
-	mitmHandler, err := mitm.InterceptTlsHandler(handler, caKey, caCert)
+func enableTls(handler http.Handler, ca *mitm.CA, certs *mitm.CertStore, upstreamTls *upstream.TLS, flags flags, accessLog accesslog.Logger) (http.Handler, error) {
+	log.Printf("using ca cert %s for tls unwrapping", ca.CertFile)
+	mitmHandler, err := mitm.InterceptTlsHandler(handler, ca, flags.TLS)
 	if err != nil {
 		return handler, err
 	}
 
-	for _, host := range mitmHosts {
+	for _, host := range flags.MitmHosts {
+		log.Printf("intercepting tls for %s", host)
 		mitmHandler.AddHost(host)
 	}
 
+	mitmHandler.SetCertStore(certs)
+	mitmHandler.SetUpstreamTLS(upstreamTls.Config)
+	mitmHandler.SetAccessLog(accessLog)
+	mitmHandler.SetIdleTimeout(flags.TunnelIdleTimeout)
+
 	return mitmHandler, nil
 }
 
@@ -119,16 +333,63 @@ func isRewriterEnabled(service string, enabled []string) bool {
 	return false
 }
 
-func buildRewriters(enabled []string) []server.Rewriter {
+// ubuntuSource picks a static list of mirrors over a mirror list url or file
+func ubuntuSource(list string, mirrors []string) ubuntu.Source {
+	if len(mirrors) > 0 {
+		return ubuntu.StaticSource(mirrors)
+	} else if strings.HasPrefix(list, "http://") || strings.HasPrefix(list, "https://") {
+		return ubuntu.URLSource(list)
+	}
+
+	return ubuntu.FileSource(list)
+}
+
+func buildRewriters(flags flags) []server.Rewriter {
 	r := []server.Rewriter{}
 
-	if isRewriterEnabled("ubuntu", enabled) {
+	if isRewriterEnabled("ubuntu", flags.EnableRewrites) {
 		log.Printf("enabling ubuntu mirror rewriting")
-		r = append(r, ubuntu.NewRewriter())
+		r = append(r, ubuntu.NewRewriter(flags.Ubuntu))
+	}
+
+	if isRewriterEnabled("debian", flags.EnableRewrites) {
+		log.Printf("enabling debian mirror rewriting")
+		d, err := debian.NewRewriter(flags.Debian)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.Start()
+		r = append(r, d)
+	}
+
+	if flags.MirrorGroups != "" {
+		groups, err := mirror.LoadGroups(flags.MirrorGroups)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, g := range groups {
+			if isRewriterEnabled(g.String(), flags.EnableRewrites) {
+				log.Printf("enabling %s mirror rewriting", g)
+				g.Start()
+				r = append(r, g)
+			}
+		}
 	}
 	return r
 }
 
+// mirrorRewriters returns the rewriters that pick between mirrors
+func mirrorRewriters(rewriters []server.Rewriter) []admin.MirrorRewriter {
+	m := []admin.MirrorRewriter{}
+	for _, r := range rewriters {
+		if mr, ok := r.(admin.MirrorRewriter); ok {
+			m = append(m, mr)
+		}
+	}
+	return m
+}
+
 func main() {
 	flags := parseFlags()
 
@@ -139,11 +400,24 @@ func main() {
 
 	log.Printf("running package-proxy %s", version)
 
-	cache, err := cache.NewDiskCache(flags.CacheDir, cacheSize)
+	if flags.Trace != "" {
+		log.Printf("sending traces to %s", flags.Trace)
+		shutdownTracing, err := tracing.Setup(flags.Trace, version)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer shutdownTracing(context.Background())
+	}
+
+	c, err := cache.NewDiskCache(flags.CacheDir, cacheSize)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	metrics.RegisterCache(func() (int, int64) {
+		return cache.Stats(c)
+	})
+
 	uid, err := uuid.NewV4()
 	if err != nil {
 		log.Fatal(err)
@@ -151,11 +425,70 @@ func main() {
 
 	log.Printf("server id is %s", uid.String())
 
+	accessLog, err := accesslog.Open(flags.AccessLog, flags.AccessLogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var upstreamTls *upstream.TLS
+	if flags.UpstreamTLS != "" {
+		log.Printf("loading upstream tls settings from %s", flags.UpstreamTLS)
+		upstreamTls, err = upstream.LoadTLS(flags.UpstreamTLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var ca *mitm.CA
+	var certs *mitm.CertStore
+	if flags.EnableTlsUnwrapping || (flags.ListenTLS != "" && flags.ListenCert == "") {
+		ca, err = mitm.LoadOrCreateCA(flags.CA)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if flags.EnableTlsUnwrapping {
+		certs, err = mitm.NewCertStore(ca, flags.LeafDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	config := &server.Config{
-		Cache:     cache,
+		Cache:     c,
 		Patterns:  cachePatterns,
-		Rewriters: buildRewriters(flags.EnableRewrites),
+		Rewriters: buildRewriters(flags),
 		ServerId:  uid.String(),
+		AccessLog: accessLog,
+		PathHosts: flags.PathHosts,
+		Local: setup.NewHandler(setup.Config{
+			CA:        ca,
+			ProxyURL:  flags.PublicURL,
+			MitmHosts: flags.MitmHosts,
+		}),
+	}
+
+	if upstreamTls != nil {
+		config.Upstream = upstreamTls.Transport()
+	}
+
+	byHash := apt.NewByHash(c)
+	go byHash.Load()
+	packages := apt.NewPackages(c)
+	go packages.Load()
+
+	config.CacheHooks = []cache.Hook{
+		byHash,
+		apt.NewSnapshots(c, cachePatterns),
+		packages,
+	}
+
+	if flags.PurgeFrom != nil {
+		config.PurgeAllowed, err = server.ParseNets(flags.PurgeFrom)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if version != "" {
@@ -164,20 +497,170 @@ func main() {
 		config.ServerId += " (package-proxy)"
 	}
 
-	var handler http.Handler
-
-	handler, err = server.NewPackageProxy(config)
+	proxy, err := server.NewPackageProxy(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var handler http.Handler = proxy
+
 	if flags.EnableTlsUnwrapping {
-		handler, err = enableTls(handler)
+		handler, err = enableTls(handler, ca, certs, upstreamTls, flags, accessLog)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	log.Printf("proxy listening on https://%s", listen)
-	log.Fatal(http.ListenAndServe(listen, handler))
+	servers := []*http.Server{}
+
+	if flags.Listen != "" {
+		servers = append(servers, serve("proxy", flags.Listen, handler))
+	}
+
+	if flags.ListenTLS != "" {
+		tlsConfig, err := listenerTlsConfig(flags, ca)
+		if err != nil {
+			log.Fatal(err)
+		}
+		servers = append(servers, serveTLS("proxy", flags.ListenTLS, handler, tlsConfig))
+	}
+
+	if len(servers) == 0 {
+		log.Fatal("one of -listen or -listen-tls is required")
+	}
+
+	if flags.TransparentHTTP != "" {
+		servers = append(servers, serve("transparent http", flags.TransparentHTTP, transparent.Handler(proxy)))
+	}
+
+	if flags.TransparentHTTPS != "" {
+		interceptor, ok := handler.(transparent.Interceptor)
+		if !ok {
+			log.Fatal("-transparent-https requires -tls")
+		}
+		serveTransparentTLS(flags.TransparentHTTPS, interceptor)
+	}
+
+	if flags.AdminListen != "" {
+		adminHandler := admin.NewHandler(config.Cache, config.Patterns)
+		adminHandler.Handle("/metrics", metrics.Handler())
+		if certs != nil {
+			adminHandler.Handle("/certs", admin.NewCertsHandler(certs))
+		}
+		adminHandler.Handle("/mirrors", admin.NewMirrorsHandler(mirrorRewriters(config.Rewriters)...))
+		servers = append(servers, serve("admin api", flags.AdminListen, adminHandler))
+	}
+
+	waitForShutdown(servers, proxy, flags.ShutdownTimeout)
+}
+
+// serve starts an http server on addr in the background
+func serve(name, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	go func() {
+		log.Printf("%s listening on http://%s", name, addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	return srv
+}
+
+// serveTLS starts an https server on addr in the background
+func serveTLS(name, addr string, handler http.Handler, config *tls.Config) *http.Server {
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: config,
+		// CONNECT needs to hijack the connection, which http/2 can't do
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+
+	go func() {
+		log.Printf("%s listening on https://%s", name, addr)
+		if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	return srv
+}
+
+// listenerTlsConfig loads the cert for the https listener, or issues one from
+// the ca for the public url, the hostname and localhost
+func listenerTlsConfig(flags flags, ca *mitm.CA) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if flags.ListenCert != "" || flags.ListenKey != "" {
+		cert, err := tls.LoadX509KeyPair(flags.ListenCert, flags.ListenKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+		return config, nil
+	}
+
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append([]string{hostname}, hosts...)
+	}
+	if u, err := url.Parse(flags.PublicURL); err == nil && u.Hostname() != "" {
+		hosts = append([]string{u.Hostname()}, hosts...)
+	}
+
+	// an intermediate ca can't issue for hosts outside its constraints, but
+	// the root it was signed with can
+	issuer := ca
+	for _, host := range hosts {
+		if !ca.Permits(host) {
+			root, err := mitm.LoadCA(flags.CA.RootKeyFile, flags.CA.RootCertFile)
+			if err != nil {
+				return nil, fmt.Errorf("%s is outside the ca's name constraints, use -listen-cert: %s", host, err.Error())
+			}
+			issuer = root
+			break
+		}
+	}
+
+	log.Printf("issuing a certificate for %s from %s", strings.Join(hosts, ", "), issuer.CertFile)
+	config.GetCertificate = issuer.GetCertificate(hosts...)
+	return config, nil
+}
+
+// serveTransparentTLS routes redirected tls connections on addr in the background
+func serveTransparentTLS(addr string, i transparent.Interceptor) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		log.Printf("transparent tls listening on %s", addr)
+		log.Fatal(transparent.ServeTLS(l, i))
+	}()
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then stops accepting connections
+// and drains in-flight requests and cache writes before closing the cache
+func waitForShutdown(servers []*http.Server, proxy *server.PackageProxy, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Printf("received %s, shutting down (waiting up to %s)", sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("error draining connections on %s: %s", srv.Addr, err.Error())
+		}
+	}
+
+	if err := proxy.Shutdown(ctx); err != nil {
+		log.Printf("error closing cache: %s", err.Error())
+	}
 }
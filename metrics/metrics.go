@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "packageproxy"
+
+var (
+	// Requests counts proxied requests by cache result (HIT, MISS, SKIP) and matched pattern
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Proxied requests by cache result and matched cache pattern.",
+	}, []string{"result", "pattern"})
+
+	// BytesServed counts response bytes sent to clients, by source (cache or upstream)
+	BytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_served_total",
+		Help:      "Response body bytes sent to clients by source.",
+	}, []string{"source"})
+
+	// UpstreamDuration observes how long upstream servers take to return response
+	// headers, by matched pattern as hosts come from clients and are unbounded
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "Time taken for upstream servers to respond, by matched cache pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pattern"})
+
+	// Expirations counts cache entries removed because they passed their max age
+	Expirations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_expirations_total",
+		Help:      "Cache entries expired after passing their max age.",
+	})
+
+	// Evictions counts cache entries that were explicitly removed
+	Evictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_evictions_total",
+		Help:      "Cache entries explicitly removed before expiring.",
+	})
+
+	// VerifyFailures counts responses that failed a cache hook's verification
+	VerifyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_verify_failures_total",
+		Help:      "Responses that failed verification before being cached or served from cache, by hook.",
+	}, []string{"hook"})
+
+	// Tunnels is the number of CONNECT tunnels currently open
+	Tunnels = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connect_tunnels_active",
+		Help:      "CONNECT tunnels currently open.",
+	})
+
+	// MirrorSelected is set to 1 for the mirror each rewriter currently uses
+	MirrorSelected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mirror_selected",
+		Help:      "The mirror each rewriter currently uses.",
+	}, []string{"rewriter", "mirror"})
+
+	// MirrorThroughput is the moving average throughput of each mirror a
+	// rewriter uses, from the requests proxied to it
+	MirrorThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mirror_throughput_bytes_per_second",
+		Help:      "Moving average throughput of requests to each mirror.",
+	}, []string{"rewriter", "mirror"})
+
+	// MirrorErrorRate is the moving average share of failed requests to each
+	// mirror a rewriter uses
+	MirrorErrorRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mirror_error_rate",
+		Help:      "Moving average share of requests to each mirror that failed.",
+	}, []string{"rewriter", "mirror"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Requests,
+		BytesServed,
+		UpstreamDuration,
+		Expirations,
+		Evictions,
+		VerifyFailures,
+		Tunnels,
+		MirrorSelected,
+		MirrorThroughput,
+		MirrorErrorRate,
+	)
+}
+
+// SetSelectedMirror marks mirror as the only one a rewriter uses, an empty
+// mirror means the rewriter isn't using one
+func SetSelectedMirror(rewriter, mirror string) {
+	MirrorSelected.DeletePartialMatch(prometheus.Labels{"rewriter": rewriter})
+	if mirror != "" {
+		MirrorSelected.WithLabelValues(rewriter, mirror).Set(1)
+	}
+}
+
+// SetMirrorStats records the moving averages of a rewriter's mirror
+func SetMirrorStats(rewriter, mirror string, throughput, errorRate float64) {
+	MirrorThroughput.WithLabelValues(rewriter, mirror).Set(throughput)
+	MirrorErrorRate.WithLabelValues(rewriter, mirror).Set(errorRate)
+}
+
+// DeleteMirrorStats removes the series of a mirror a rewriter no longer uses
+func DeleteMirrorStats(rewriter, mirror string) {
+	labels := prometheus.Labels{"rewriter": rewriter, "mirror": mirror}
+	MirrorThroughput.DeletePartialMatch(labels)
+	MirrorErrorRate.DeletePartialMatch(labels)
+}
+
+// StatsFunc returns the number of entries in a cache and their total size in bytes
+type StatsFunc func() (entries int, size int64)
+
+// RegisterCache exposes the size of a cache, fn is called on every scrape
+func RegisterCache(fn StatsFunc) {
+	prometheus.MustRegister(&cacheCollector{fn})
+}
+
+var (
+	cacheEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "entries"),
+		"Number of entries in the cache.", nil, nil,
+	)
+	cacheSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "size_bytes"),
+		"Total size of entries in the cache.", nil, nil,
+	)
+)
+
+type cacheCollector struct {
+	stats StatsFunc
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheEntriesDesc
+	ch <- cacheSizeDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	entries, size := c.stats()
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(entries))
+	ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(size))
+}
+
+// Handler serves metrics in the prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,380 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lox/package-proxy/metrics"
+)
+
+const (
+	healthInterval = time.Minute
+	downFor        = time.Minute * 5
+	explore        = 0.05
+	checkTimeout   = time.Second * 20
+)
+
+// Strategy is how a group picks which healthy mirror to use
+type Strategy string
+
+const (
+	// Fastest uses the mirror with the best throughput on live traffic,
+	// sending an Explore share of requests to the others
+	Fastest Strategy = "fastest"
+
+	// Ordered uses the first healthy mirror in the order they're given
+	Ordered Strategy = "ordered"
+
+	// Random spreads requests across the healthy mirrors
+	Random Strategy = "random"
+)
+
+// Config describes a group of mirrors for one or more origins, zero values
+// use the defaults
+type Config struct {
+	// Name identifies the group in logs, metrics and the admin api
+	Name string
+
+	// Origins are the urls the group rewrites, the path after an origin is
+	// appended to the mirror's url
+	Origins []Origin
+
+	// Mirrors are the candidate mirror urls
+	Mirrors []string
+
+	// Strategy defaults to Fastest
+	Strategy Strategy
+
+	// Explore is the share of requests Fastest sends to mirrors other than
+	// the best, negative sends every request to the best
+	Explore float64
+
+	// Client is used for health checks
+	Client *http.Client
+
+	// HealthPath is fetched from each mirror every HealthInterval, a mirror
+	// that fails a check or a request isn't used for DownFor. Without a
+	// HealthPath or Check, mirrors are only marked down by failed requests.
+	HealthPath     string
+	HealthInterval time.Duration
+	DownFor        time.Duration
+
+	// Check replaces fetching HealthPath, it returns an error for each of
+	// the mirrors that is unhealthy
+	Check func(mirrors []string) []error
+
+	// Canonical is the url requests for CanonicalPaths under any of the
+	// origins are cached under, for files that are the same on every origin
+	Canonical      *url.URL
+	CanonicalPaths []string
+
+	// Refresh returns new candidate mirrors every RefreshInterval
+	Refresh         func() ([]string, error)
+	RefreshInterval time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.Strategy == "" {
+		c.Strategy = Fastest
+	}
+	if c.Explore == 0 {
+		c.Explore = explore
+	}
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: checkTimeout}
+	}
+	if c.HealthInterval == 0 {
+		c.HealthInterval = healthInterval
+	}
+	if c.DownFor == 0 {
+		c.DownFor = downFor
+	}
+	return c
+}
+
+// Group rewrites requests for its origins to one of its healthy mirrors.
+// Requests keep their canonical url, so they are cached under the same key
+// whichever mirror they are fetched from. If every mirror is down requests
+// go to the origin.
+type Group struct {
+	sync.RWMutex
+	config  Config
+	mirrors []*mirror
+	active  string
+	rand    *rand.Rand
+}
+
+// mirror is a candidate mirror, in the order it was given
+type mirror struct {
+	url       *url.URL
+	downUntil time.Time
+	stats     stats
+}
+
+func (m *mirror) healthy(now time.Time) bool {
+	return now.After(m.downUntil)
+}
+
+// NewGroup returns a group using the config's Mirrors, Start begins health
+// checks and refreshes
+func NewGroup(config Config) (*Group, error) {
+	config = config.withDefaults()
+
+	switch config.Strategy {
+	case Fastest, Ordered, Random:
+	default:
+		return nil, fmt.Errorf("mirror group %s has an unknown strategy %q", config.Name, config.Strategy)
+	}
+
+	if len(config.Origins) == 0 {
+		return nil, fmt.Errorf("mirror group %s has no origins", config.Name)
+	}
+
+	g := &Group{config: config, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if len(config.Mirrors) > 0 {
+		if err := g.SetMirrors(config.Mirrors...); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// Start health checks and refreshes the mirrors in the background
+func (g *Group) Start() {
+	go g.monitor()
+}
+
+func (g *Group) String() string {
+	return g.config.Name
+}
+
+// SetMirrors replaces the candidate mirrors, the stats of mirrors that were
+// already in use are kept
+func (g *Group) SetMirrors(urls ...string) error {
+	if len(urls) == 0 {
+		return errors.New("no mirrors")
+	}
+
+	g.RLock()
+	existing := map[string]*mirror{}
+	for _, m := range g.mirrors {
+		existing[m.url.String()] = m
+	}
+	g.RUnlock()
+
+	mirrors := []*mirror{}
+	for _, u := range urls {
+		if !strings.HasSuffix(u, "/") {
+			u += "/"
+		}
+		mirrorUrl, err := url.Parse(u)
+		if err != nil {
+			return err
+		}
+		if m, ok := existing[mirrorUrl.String()]; ok {
+			mirrors = append(mirrors, m)
+		} else {
+			mirrors = append(mirrors, &mirror{url: mirrorUrl})
+		}
+	}
+
+	log.Printf("using %s mirrors %s", g.config.Name, strings.Join(urls, ", "))
+	g.Lock()
+	g.mirrors = mirrors
+	g.Unlock()
+
+	for _, m := range mirrors {
+		delete(existing, m.url.String())
+	}
+	for u := range existing {
+		metrics.DeleteMirrorStats(g.config.Name, u)
+	}
+
+	g.updateActive()
+	return nil
+}
+
+// Mirror returns the best healthy mirror, nil if there isn't one
+func (g *Group) Mirror() *url.URL {
+	g.RLock()
+	defer g.RUnlock()
+
+	if m := g.best(time.Now()); m != nil {
+		return m.url
+	}
+
+	return nil
+}
+
+// pick returns the mirror to send a request to, depending on the strategy
+func (g *Group) pick() *url.URL {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	best := g.best(now)
+	if best == nil {
+		return nil
+	}
+
+	healthy := []*mirror{}
+	for _, m := range g.mirrors {
+		if m.healthy(now) {
+			healthy = append(healthy, m)
+		}
+	}
+
+	switch g.config.Strategy {
+	case Random:
+		return healthy[g.rand.Intn(len(healthy))].url
+	case Fastest:
+		if len(healthy) > 1 && g.config.Explore > 0 && g.rand.Float64() < g.config.Explore {
+			for {
+				if m := healthy[g.rand.Intn(len(healthy))]; m != best {
+					return m.url
+				}
+			}
+		}
+	}
+
+	return best.url
+}
+
+// updateActive logs and records when the mirror in use changes
+func (g *Group) updateActive() {
+	active := ""
+	if m := g.Mirror(); m != nil {
+		active = m.String()
+	}
+
+	g.Lock()
+	changed := active != g.active
+	g.active = active
+	g.Unlock()
+
+	if !changed {
+		return
+	} else if active == "" {
+		log.Printf("no healthy %s mirrors, using the origin", g.config.Name)
+	} else {
+		log.Printf("using %s mirror %s", g.config.Name, active)
+	}
+
+	metrics.SetSelectedMirror(g.config.Name, active)
+}
+
+// markDown stops using a mirror until a health check passes or the config's
+// DownFor passes
+func (g *Group) markDown(m *mirror) {
+	g.Lock()
+	m.downUntil = time.Now().Add(g.config.DownFor)
+	g.Unlock()
+	g.updateActive()
+}
+
+func (g *Group) markUp(m *mirror) {
+	g.Lock()
+	m.downUntil = time.Time{}
+	g.Unlock()
+	g.updateActive()
+}
+
+// find returns the mirror a url was rewritten to
+func (g *Group) find(u *url.URL) *mirror {
+	g.RLock()
+	defer g.RUnlock()
+
+	for _, m := range g.mirrors {
+		if u.Host == m.url.Host && strings.HasPrefix(u.Path, m.url.Path) {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// match returns the path of u after the origin it matches
+func (g *Group) match(u *url.URL) (string, bool) {
+	for _, o := range g.config.Origins {
+		if rest, ok := o.Match(u); ok {
+			return rest, true
+		}
+	}
+
+	return "", false
+}
+
+// Rewrite sends requests for the group's origins to a mirror
+func (g *Group) Rewrite(r *http.Request) {
+	rest, ok := g.match(r.URL)
+	if !ok {
+		return
+	}
+
+	if mirror := g.pick(); mirror != nil {
+		rewrite(r.URL, mirror, rest)
+	}
+}
+
+// Canonical returns the url a request for one of the config's
+// CanonicalPaths is cached under, whichever origin it was for
+func (g *Group) Canonical(u *url.URL) (string, bool) {
+	if g.config.Canonical == nil {
+		return "", false
+	}
+
+	rest, ok := g.match(u)
+	if !ok {
+		return "", false
+	}
+
+	for _, p := range g.config.CanonicalPaths {
+		if strings.HasPrefix(rest, p) {
+			c := *u
+			rewrite(&c, g.config.Canonical, rest)
+			return c.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// Failover marks the mirror a failed request went to as down and returns the
+// best remaining mirror, or the original url once there are no healthy
+// mirrors left
+func (g *Group) Failover(req *http.Request, original *url.URL, resp *http.Response, err error) *url.URL {
+	rest, ok := g.match(original)
+	if !ok {
+		return nil
+	}
+
+	failed := g.find(req.URL)
+	if failed == nil {
+		return nil
+	}
+
+	log.Printf("%s mirror %s failed", g.config.Name, failed.url)
+	g.markDown(failed)
+
+	u := *original
+	if next := g.Mirror(); next != nil {
+		rewrite(&u, next, rest)
+	}
+
+	return &u
+}
+
+func rewrite(u *url.URL, mirror *url.URL, rest string) {
+	u.Scheme = mirror.Scheme
+	u.Host = mirror.Host
+	u.Path = mirror.Path + rest
+	u.RawPath = ""
+}
@@ -0,0 +1,174 @@
+package mirror
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lox/package-proxy/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func mustOrigin(t *testing.T, s string) Origin {
+	o, err := ParseOrigin(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOriginMatch(t *testing.T) {
+	o := mustOrigin(t, "ftp.*.debian.org/debian")
+
+	for _, tc := range []struct {
+		url, rest string
+		ok        bool
+	}{
+		{"http://ftp.au.debian.org/debian/pool/main/b/bash.deb", "pool/main/b/bash.deb", true},
+		{"https://FTP.us.debian.org/debian/dists/bookworm/InRelease", "dists/bookworm/InRelease", true},
+		{"http://ftp.au.debian.org/debian-security/pool/main/b/bash.deb", "", false},
+		{"http://deb.debian.org/debian/pool/main/b/bash.deb", "", false},
+	} {
+		u, _ := url.Parse(tc.url)
+		rest, ok := o.Match(u)
+		if ok != tc.ok || rest != tc.rest {
+			t.Errorf("Expected %s to match %v with %q, got %v %q", tc.url, tc.ok, tc.rest, ok, rest)
+		}
+	}
+}
+
+func TestGroupRewritesOrigins(t *testing.T) {
+	g, err := NewGroup(Config{
+		Name:    "npm",
+		Origins: []Origin{mustOrigin(t, "http://registry.npmjs.org/")},
+		Mirrors: []string{"https://npm.example.org/registry"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://registry.npmjs.org/left-pad/-/left-pad-1.3.0.tgz?x=1", nil)
+	g.Rewrite(req)
+
+	if req.URL.String() != "https://npm.example.org/registry/left-pad/-/left-pad-1.3.0.tgz?x=1" {
+		t.Fatalf("Unexpected rewrite %s", req.URL)
+	}
+
+	req, _ = http.NewRequest("GET", "http://pypi.org/simple/", nil)
+	g.Rewrite(req)
+
+	if req.URL.Host != "pypi.org" {
+		t.Fatalf("Expected other origins to be left alone, got %s", req.URL)
+	}
+}
+
+func TestRemovedMirrorsLoseTheirStats(t *testing.T) {
+	g, err := NewGroup(Config{
+		Name:    "removed",
+		Origins: []Origin{mustOrigin(t, "http://registry.npmjs.org/")},
+		Mirrors: []string{"https://a.example.org/", "https://b.example.org/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "https://a.example.org/left-pad", nil)
+	g.Observe(req, 1024, time.Second, nil)
+	series := testutil.CollectAndCount(metrics.MirrorErrorRate)
+
+	if stats := g.MirrorStats(); stats[0].Group != "removed" {
+		t.Fatalf("Expected stats to name their group, got %q", stats[0].Group)
+	}
+
+	if err := g.SetMirrors("https://b.example.org/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.CollectAndCount(metrics.MirrorErrorRate); n != series-1 {
+		t.Fatalf("Expected the removed mirror's series to be deleted, got %d series from %d", n, series)
+	}
+}
+
+func TestOrderedGroupsFailOverInOrder(t *testing.T) {
+	g, err := NewGroup(Config{
+		Name:     "pypi",
+		Origins:  []Origin{mustOrigin(t, "pypi.org/")},
+		Mirrors:  []string{"http://a.example.org/", "http://b.example.org/", "http://c.example.org/"},
+		Strategy: Ordered,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, _ := url.Parse("http://pypi.org/simple/requests/")
+	req, _ := http.NewRequest("GET", original.String(), nil)
+	g.Rewrite(req)
+
+	if req.URL.Host != "a.example.org" {
+		t.Fatalf("Expected the first mirror, got %s", req.URL)
+	}
+
+	next := g.Failover(req, original, nil, errors.New("timeout"))
+	if next == nil || next.String() != "http://b.example.org/simple/requests/" {
+		t.Fatalf("Expected failover to the second mirror, got %v", next)
+	}
+
+	stats := g.MirrorStats()
+	if stats[0].URL != "http://b.example.org/" || stats[2].Healthy {
+		t.Fatalf("Expected the failed mirror to be ranked last, got %#v", stats)
+	}
+}
+
+func TestRandomGroupsSpreadRequests(t *testing.T) {
+	g, err := NewGroup(Config{
+		Name:     "debian",
+		Origins:  []Origin{mustOrigin(t, "deb.debian.org/debian/")},
+		Mirrors:  []string{"http://a.example.org/debian/", "http://b.example.org/debian/"},
+		Strategy: Random,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", "http://deb.debian.org/debian/dists/bookworm/InRelease", nil)
+		g.Rewrite(req)
+		hosts[req.URL.Host]++
+	}
+
+	if hosts["a.example.org"] == 0 || hosts["b.example.org"] == 0 {
+		t.Fatalf("Expected requests to both mirrors, got %v", hosts)
+	}
+}
+
+func TestLoadGroups(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mirrors.json")
+	ioutil.WriteFile(file, []byte(`{
+		"npm": {
+			"origins": ["registry.npmjs.org"],
+			"mirrors": ["http://npm.example.org/"],
+			"strategy": "ordered",
+			"health_path": "-/ping",
+			"down_for": "1m"
+		}
+	}`), 0644)
+
+	groups, err := LoadGroups(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 1 || groups[0].String() != "npm" || groups[0].config.Strategy != Ordered {
+		t.Fatalf("Unexpected groups %#v", groups)
+	}
+
+	ioutil.WriteFile(file, []byte(`{"npm": {"origins": ["registry.npmjs.org"], "mirrors": ["http://npm.example.org/"], "strategy": "nearest"}}`), 0644)
+	if _, err := LoadGroups(file); err == nil {
+		t.Fatal("Expected an unknown strategy to fail")
+	}
+}
@@ -0,0 +1,98 @@
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// monitor health checks the mirrors every HealthInterval and refreshes them
+// every RefreshInterval
+func (g *Group) monitor() {
+	var health, refresh <-chan time.Time
+
+	if g.config.HealthPath != "" || g.config.Check != nil {
+		t := time.NewTicker(g.config.HealthInterval)
+		defer t.Stop()
+		health = t.C
+	}
+
+	if g.config.Refresh != nil && g.config.RefreshInterval > 0 {
+		t := time.NewTicker(g.config.RefreshInterval)
+		defer t.Stop()
+		refresh = t.C
+	}
+
+	if health == nil && refresh == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-health:
+			g.CheckHealth()
+		case <-refresh:
+			g.refresh()
+		}
+	}
+}
+
+// CheckHealth checks every mirror now, marking those that fail down and
+// those that pass up
+func (g *Group) CheckHealth() {
+	g.RLock()
+	mirrors := append([]*mirror{}, g.mirrors...)
+	g.RUnlock()
+
+	urls := make([]string, len(mirrors))
+	for i, m := range mirrors {
+		urls[i] = m.url.String()
+	}
+
+	check := g.config.Check
+	if check == nil {
+		check = g.check
+	}
+
+	for i, err := range check(urls) {
+		if err != nil {
+			log.Printf("%s mirror %s failed a health check: %s", g.config.Name, urls[i], err.Error())
+			g.markDown(mirrors[i])
+		} else {
+			g.markUp(mirrors[i])
+		}
+	}
+}
+
+// check fetches the HealthPath from each mirror
+func (g *Group) check(mirrors []string) []error {
+	errs := make([]error, len(mirrors))
+
+	for i, m := range mirrors {
+		resp, err := g.config.Client.Get(m + g.config.HealthPath)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			errs[i] = fmt.Errorf("returned %s", resp.Status)
+		}
+	}
+
+	return errs
+}
+
+func (g *Group) refresh() {
+	log.Printf("refreshing %s mirrors", g.config.Name)
+
+	mirrors, err := g.config.Refresh()
+	if err != nil {
+		log.Printf("error refreshing %s mirrors, keeping the current ones: %s", g.config.Name, err.Error())
+		return
+	}
+
+	g.SetMirrors(mirrors...)
+}
@@ -0,0 +1,107 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// GroupConfig is how a group is described in a json file
+type GroupConfig struct {
+	Origins        []string `json:"origins"`
+	Mirrors        []string `json:"mirrors"`
+	Strategy       Strategy `json:"strategy"`
+	Explore        float64  `json:"explore"`
+	HealthPath     string   `json:"health_path"`
+	HealthInterval string   `json:"health_interval"`
+	DownFor        string   `json:"down_for"`
+	Canonical      string   `json:"canonical"`
+	CanonicalPaths []string `json:"canonical_paths"`
+}
+
+// Config converts the json config of a named group
+func (gc GroupConfig) Config(name string) (Config, error) {
+	config := Config{
+		Name:           name,
+		Mirrors:        gc.Mirrors,
+		Strategy:       gc.Strategy,
+		Explore:        gc.Explore,
+		HealthPath:     gc.HealthPath,
+		CanonicalPaths: gc.CanonicalPaths,
+	}
+
+	if gc.Canonical != "" {
+		canonical, err := url.Parse(gc.Canonical)
+		if err != nil {
+			return Config{}, fmt.Errorf("mirror group %s: %s", name, err.Error())
+		}
+		config.Canonical = canonical
+	}
+
+	for _, o := range gc.Origins {
+		origin, err := ParseOrigin(o)
+		if err != nil {
+			return Config{}, fmt.Errorf("mirror group %s: %s", name, err.Error())
+		}
+		config.Origins = append(config.Origins, origin)
+	}
+
+	var err error
+	if config.HealthInterval, err = parseDuration(gc.HealthInterval); err != nil {
+		return Config{}, fmt.Errorf("mirror group %s: %s", name, err.Error())
+	}
+	if config.DownFor, err = parseDuration(gc.DownFor); err != nil {
+		return Config{}, fmt.Errorf("mirror group %s: %s", name, err.Error())
+	}
+
+	return config, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// LoadGroups reads a json file mapping group names to a GroupConfig, the
+// groups are returned sorted by name and aren't started
+func LoadGroups(file string) ([]*Group, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := map[string]GroupConfig{}
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+
+	names := []string{}
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []*Group{}
+	for _, name := range names {
+		config, err := configs[name].Config(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(config.Mirrors) == 0 {
+			return nil, fmt.Errorf("mirror group %s has no mirrors", name)
+		}
+
+		g, err := NewGroup(config)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,52 @@
+package mirror
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Origin is a host and path prefix that a group serves from its mirrors, the
+// scheme isn't matched. The host can be a glob like ftp.*.debian.org.
+type Origin struct {
+	Host string
+	Path string
+}
+
+// ParseOrigin parses an origin like http://archive.ubuntu.com/ubuntu/, the
+// path always ends in a slash
+func ParseOrigin(s string) (Origin, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return Origin{}, err
+	} else if u.Host == "" {
+		return Origin{}, fmt.Errorf("origin %q has no host", s)
+	}
+
+	p := u.Path
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+
+	return Origin{Host: strings.ToLower(u.Host), Path: p}, nil
+}
+
+// Match returns the path of u after the origin's path
+func (o Origin) Match(u *url.URL) (string, bool) {
+	if ok, _ := path.Match(o.Host, strings.ToLower(u.Host)); !ok {
+		return "", false
+	} else if !strings.HasPrefix(u.Path, o.Path) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(u.Path, o.Path), true
+}
+
+func (o Origin) String() string {
+	return o.Host + o.Path
+}
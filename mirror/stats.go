@@ -0,0 +1,142 @@
+package mirror
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/lox/package-proxy/metrics"
+)
+
+const (
+	// ewmaWeight is how much each request moves a mirror's averages
+	ewmaWeight = 0.2
+
+	// minThroughputBytes is the smallest response used to measure throughput,
+	// smaller ones mostly measure latency
+	minThroughputBytes = 64 * 1024
+)
+
+// stats are a mirror's averages from the requests proxied to it
+type stats struct {
+	requests   int64
+	errors     int64
+	throughput float64 // ewma bytes per second
+	errorRate  float64 // ewma of failed requests, 0 to 1
+}
+
+func ewma(avg, value float64, first bool) float64 {
+	if first {
+		return value
+	}
+	return avg + ewmaWeight*(value-avg)
+}
+
+// score ranks mirrors with a measured throughput, discounted by errors
+func (s stats) score() float64 {
+	return s.throughput * (1 - s.errorRate)
+}
+
+func (s stats) sampled() bool {
+	return s.throughput > 0
+}
+
+// MirrorStats describes a mirror and its averages from live traffic
+type MirrorStats struct {
+	Group      string    `json:"group"`
+	URL        string    `json:"url"`
+	Rank       int       `json:"rank"`
+	Selected   bool      `json:"selected"`
+	Healthy    bool      `json:"healthy"`
+	DownUntil  time.Time `json:"down_until,omitempty"`
+	Requests   int64     `json:"requests"`
+	Errors     int64     `json:"errors"`
+	Throughput float64   `json:"throughput_bytes_per_second"`
+	ErrorRate  float64   `json:"error_rate"`
+}
+
+// Observe updates the stats of the mirror a request was sent to
+func (g *Group) Observe(req *http.Request, bytes int64, duration time.Duration, err error) {
+	m := g.find(req.URL)
+	if m == nil {
+		return
+	}
+
+	g.Lock()
+	s := &m.stats
+	failed := 0.0
+	if err != nil {
+		failed = 1
+		s.errors++
+	}
+	s.errorRate = ewma(s.errorRate, failed, s.requests == 0)
+	s.requests++
+
+	if err == nil && bytes >= minThroughputBytes && duration > 0 {
+		s.throughput = ewma(s.throughput, float64(bytes)/duration.Seconds(), !s.sampled())
+	}
+
+	url, current := m.url.String(), *s
+	g.Unlock()
+
+	metrics.SetMirrorStats(g.config.Name, url, current.throughput, current.errorRate)
+	g.updateActive()
+}
+
+// MirrorStats returns the stats of each mirror, in the order they'd be used
+func (g *Group) MirrorStats() []MirrorStats {
+	g.RLock()
+	defer g.RUnlock()
+
+	now := time.Now()
+	ranked := g.ranked(now)
+	best := g.best(now)
+
+	infos := []MirrorStats{}
+	for i, m := range ranked {
+		infos = append(infos, MirrorStats{
+			Group:      g.config.Name,
+			URL:        m.url.String(),
+			Rank:       i + 1,
+			Selected:   m == best,
+			Healthy:    m.healthy(now),
+			DownUntil:  m.downUntil,
+			Requests:   m.stats.requests,
+			Errors:     m.stats.errors,
+			Throughput: m.stats.throughput,
+			ErrorRate:  m.stats.errorRate,
+		})
+	}
+
+	return infos
+}
+
+// ranked orders the healthy mirrors before those that are down. With the
+// Fastest strategy they are ordered by their score from live traffic,
+// followed by those without enough traffic to score in the order given.
+func (g *Group) ranked(now time.Time) []*mirror {
+	ranked := append([]*mirror{}, g.mirrors...)
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.healthy(now) != b.healthy(now) {
+			return a.healthy(now)
+		} else if g.config.Strategy != Fastest {
+			return false
+		} else if a.stats.sampled() != b.stats.sampled() {
+			return a.stats.sampled()
+		}
+		return a.stats.score() > b.stats.score()
+	})
+
+	return ranked
+}
+
+// best returns the healthy mirror to use, or nil
+func (g *Group) best(now time.Time) *mirror {
+	if ranked := g.ranked(now); len(ranked) > 0 && ranked[0].healthy(now) {
+		return ranked[0]
+	}
+
+	return nil
+}
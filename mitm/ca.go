@@ -0,0 +1,258 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	f "path/filepath"
+	"time"
+)
+
+const (
+	caKeyFile  = "packageproxy-ca.key"
+	caCertFile = "packageproxy-ca.crt"
+	caKeyBits  = 2048
+)
+
+// CAConfig describes where the certificate authority used for interception
+// lives and how to create it if it doesn't exist yet
+type CAConfig struct {
+	// Dir is where a generated CA is stored
+	Dir string
+
+	// KeyFile and CertFile point at an existing CA, they override Dir
+	KeyFile, CertFile string
+
+	// Subject and Validity are used when generating a new CA
+	Subject  pkix.Name
+	Validity time.Duration
+
+	// RootKeyFile and RootCertFile are a root used to sign an intermediate
+	// CA in Dir that is name constrained to the Permitted host patterns
+	RootKeyFile, RootCertFile string
+	Permitted                 []string
+}
+
+// CA is a certificate authority used to sign certificates for intercepted hosts
+type CA struct {
+	Cert     *x509.Certificate
+	Key      crypto.Signer
+	KeyFile  string
+	CertFile string
+
+	// Root signed an intermediate CA, it's nil for a self-signed CA
+	Root *x509.Certificate
+}
+
+// LoadOrCreateCA loads the CA described by config, generating and storing a
+// new one in config.Dir on first start
+func LoadOrCreateCA(config CAConfig) (*CA, error) {
+	keyFile, certFile := config.KeyFile, config.CertFile
+
+	if keyFile != "" || certFile != "" {
+		if keyFile == "" || certFile == "" {
+			return nil, errors.New("both a ca key and cert must be provided")
+		}
+		return LoadCA(keyFile, certFile)
+	}
+
+	if config.RootKeyFile != "" || config.RootCertFile != "" {
+		if config.RootKeyFile == "" || config.RootCertFile == "" {
+			return nil, errors.New("both a root key and cert must be provided")
+		}
+		return loadOrCreateIntermediate(config)
+	}
+
+	keyFile = f.Join(config.Dir, caKeyFile)
+	certFile = f.Join(config.Dir, caCertFile)
+
+	if _, err := os.Stat(certFile); err == nil {
+		return LoadCA(keyFile, certFile)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("generating new ca in %s", config.Dir)
+	ca, err := NewCA(config.Subject, config.Validity)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ca.Save(keyFile, certFile); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+// LoadCA reads a PEM encoded CA key and certificate
+func LoadCA(keyFile, certFile string) (*CA, error) {
+	cert, err := readCert(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := readKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s isn't a ca certificate", certFile)
+	}
+
+	if remaining := cert.NotAfter.Sub(time.Now()); remaining < 0 {
+		return nil, fmt.Errorf("ca certificate %s expired on %s", certFile, cert.NotAfter)
+	} else if remaining < time.Hour*24*30 {
+		log.Printf("warning: ca certificate %s expires on %s", certFile, cert.NotAfter)
+	}
+
+	return &CA{Cert: cert, Key: key, KeyFile: keyFile, CertFile: certFile}, nil
+}
+
+// NewCA generates a self-signed CA
+func NewCA(subject pkix.Name, validity time.Duration) (*CA, error) {
+	key, err := rsa.GenerateKey(rand.Reader, caKeyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// Save writes the CA key and cert, the key is only readable by the owner
+func (ca *CA) Save(keyFile, certFile string) error {
+	for _, dir := range []string{f.Dir(keyFile), f.Dir(certFile)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	keyPem, err := encodeKey(ca.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(certFile, ca.CertPEM(), 0644); err != nil {
+		return err
+	}
+
+	ca.KeyFile, ca.CertFile = keyFile, certFile
+	return nil
+}
+
+// CertPEM returns the PEM encoded CA certificate
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// Trusted returns the certificate clients need to trust, which is the root
+// for an intermediate CA
+func (ca *CA) Trusted() *x509.Certificate {
+	if ca.Root != nil {
+		return ca.Root
+	}
+	return ca.Cert
+}
+
+func readCert(file string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readKey(file string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", file)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported private key type %q in %s", block.Type, file)
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}), nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
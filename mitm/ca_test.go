@@ -0,0 +1,51 @@
+package mitm
+
+import (
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	f "path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateCAPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "package-proxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := CAConfig{
+		Dir:      f.Join(dir, "certs"),
+		Subject:  pkix.Name{CommonName: "Test CA"},
+		Validity: time.Hour,
+	}
+
+	ca1, err := LoadOrCreateCA(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(ca1.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected key to be 0600, got %s", info.Mode().Perm())
+	}
+
+	ca2, err := LoadOrCreateCA(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ca1.Cert.SerialNumber.Cmp(ca2.Cert.SerialNumber) != 0 {
+		t.Fatal("Expected the ca to be reused on second load")
+	}
+
+	if ca2.Cert.Subject.CommonName != "Test CA" {
+		t.Fatalf("Unexpected ca subject %s", ca2.Cert.Subject)
+	}
+}
@@ -0,0 +1,304 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCertNotFound is returned when revoking a host without a certificate
+var ErrCertNotFound = errors.New("certificate not found")
+
+var safeHost = regexp.MustCompile(`^[a-z0-9_\-\[\]:][a-z0-9_.\-\[\]:]*$`)
+
+const (
+	leafValidity = time.Hour * 24 * 90
+	leafRenew    = time.Hour * 24
+)
+
+// Leaf generates an ECDSA certificate for hosts signed by the CA, the first
+// host is used as the common name
+func (ca *CA) Leaf(hosts ...string) (*tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("a leaf certificate needs at least one host")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(leafValidity)
+	if notAfter.After(ca.Cert.NotAfter) {
+		notAfter = ca.Cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   hosts[0],
+			Organization: ca.Cert.Subject.Organization,
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// GetCertificate returns a tls.Config.GetCertificate func that serves a
+// leaf for hosts, generating a new one when it's close to expiring
+func (ca *CA) GetCertificate(hosts ...string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var mu sync.Mutex
+	var cert *tls.Certificate
+
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if cert == nil || time.Until(cert.Leaf.NotAfter) < leafRenew {
+			c, err := ca.Leaf(hosts...)
+			if err != nil {
+				return nil, err
+			}
+			cert = c
+		}
+
+		return cert, nil
+	}
+}
+
+// LeafInfo describes a generated leaf certificate
+type LeafInfo struct {
+	Host      string
+	Serial    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// CertStore keeps generated leaf certificates until they're close to
+// expiring. If dir is set they are also stored there as <host>.pem so they
+// survive restarts.
+type CertStore struct {
+	sync.Mutex
+	ca    *CA
+	dir   string
+	certs map[string]*tls.Certificate
+}
+
+// NewCertStore returns a store of leaf certs signed by ca, an empty dir keeps
+// them in memory only
+func NewCertStore(ca *CA, dir string) (*CertStore, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &CertStore{ca: ca, dir: dir, certs: map[string]*tls.Certificate{}}, nil
+}
+
+// Get returns a certificate for host, loading it from disk or generating a
+// new one if there isn't a current one
+func (s *CertStore) Get(host string) (*tls.Certificate, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if cert, ok := s.certs[host]; ok && s.current(cert) {
+		return cert, nil
+	}
+
+	if cert, err := s.load(host); err == nil && s.current(cert) {
+		s.certs[host] = cert
+		return cert, nil
+	}
+
+	cert, err := s.ca.Leaf(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.save(host, cert); err != nil {
+		log.Printf("error storing certificate for %s: %s", host, err.Error())
+	}
+
+	s.certs[host] = cert
+	return cert, nil
+}
+
+// current checks a cert isn't about to expire and is signed by the current ca
+func (s *CertStore) current(cert *tls.Certificate) bool {
+	return time.Until(cert.Leaf.NotAfter) > leafRenew &&
+		cert.Leaf.CheckSignatureFrom(s.ca.Cert) == nil
+}
+
+// List returns the certificates in the store, sorted by host
+func (s *CertStore) List() ([]LeafInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	certs := map[string]*tls.Certificate{}
+	for host, cert := range s.certs {
+		certs[host] = cert
+	}
+
+	if s.dir != "" {
+		files, err := filepath.Glob(filepath.Join(s.dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			host := strings.TrimSuffix(filepath.Base(file), ".pem")
+			if _, ok := certs[host]; ok {
+				continue
+			}
+			if cert, err := s.load(host); err == nil {
+				certs[host] = cert
+			}
+		}
+	}
+
+	infos := []LeafInfo{}
+	for host, cert := range certs {
+		infos = append(infos, LeafInfo{
+			Host:      host,
+			Serial:    cert.Leaf.SerialNumber.Text(16),
+			NotBefore: cert.Leaf.NotBefore,
+			NotAfter:  cert.Leaf.NotAfter,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Host < infos[j].Host
+	})
+
+	return infos, nil
+}
+
+// Revoke removes the certificate for host, a new one is generated on the
+// next connection
+func (s *CertStore) Revoke(host string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	_, found := s.certs[host]
+	delete(s.certs, host)
+
+	if file, ok := s.file(host); ok {
+		err := os.Remove(file)
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if !found {
+		return ErrCertNotFound
+	}
+
+	return nil
+}
+
+// file returns where a host's cert is stored, hosts that aren't safe to use
+// as a filename aren't stored
+func (s *CertStore) file(host string) (string, bool) {
+	if s.dir == "" || !safeHost.MatchString(host) {
+		return "", false
+	}
+
+	return filepath.Join(s.dir, host+".pem"), true
+}
+
+func (s *CertStore) load(host string) (*tls.Certificate, error) {
+	file, ok := s.file(host)
+	if !ok {
+		return nil, ErrCertNotFound
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cert, nil
+}
+
+func (s *CertStore) save(host string, cert *tls.Certificate) error {
+	file, ok := s.file(host)
+	if !ok {
+		return nil
+	}
+
+	key, err := encodeKey(cert.PrivateKey.(crypto.Signer))
+	if err != nil {
+		return err
+	}
+
+	b := []byte{}
+	for _, der := range cert.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	return ioutil.WriteFile(file, append(b, key...), 0600)
+}
@@ -0,0 +1,78 @@
+package mitm
+
+import (
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertStorePersistsLeaves(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewCA(pkix.Name{CommonName: "Test CA"}, time.Hour*24*365)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewCertStore(ca, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := store.Get("registry.npmjs.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "registry.npmjs.org.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new store simulates a restart
+	store, _ = NewCertStore(ca, dir)
+	reloaded, err := store.Get("registry.npmjs.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reloaded.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Fatal("Expected the stored certificate to be reused")
+	}
+}
+
+func TestCertStoreRotatesCertsFromOtherCAs(t *testing.T) {
+	dir := t.TempDir()
+	old, _ := NewCA(pkix.Name{CommonName: "Old CA"}, time.Hour*24*365)
+	current, _ := NewCA(pkix.Name{CommonName: "Current CA"}, time.Hour*24*365)
+
+	store, _ := NewCertStore(old, dir)
+	if _, err := store.Get("registry.npmjs.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, _ = NewCertStore(current, dir)
+	cert, err := store.Get("registry.npmjs.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cert.Leaf.CheckSignatureFrom(current.Cert); err != nil {
+		t.Fatalf("Expected a certificate from the current ca: %s", err)
+	}
+}
+
+func TestCertStoreDoesntStoreUnsafeHosts(t *testing.T) {
+	dir := t.TempDir()
+	ca, _ := NewCA(pkix.Name{CommonName: "Test CA"}, time.Hour*24*365)
+	store, _ := NewCertStore(ca, dir)
+
+	if _, err := store.Get("../llamas"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), "*.pem"))
+	if len(files) != 0 {
+		t.Fatalf("Expected no files outside the store, got %v", files)
+	}
+}
@@ -0,0 +1,48 @@
+package mitm
+
+import (
+	"net"
+	"strings"
+)
+
+// hostPattern matches the host of a CONNECT request. Patterns can be an exact
+// host, "*.example.org" for any subdomain or ".example.org" for the domain and
+// all of its subdomains. A pattern with a port only matches that port.
+type hostPattern struct {
+	host, port string
+}
+
+func parseHostPattern(s string) hostPattern {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, ""
+	}
+
+	return hostPattern{strings.ToLower(host), port}
+}
+
+func (p hostPattern) match(host, port string) bool {
+	if p.port != "" && p.port != port {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(p.host, "*."):
+		return strings.HasSuffix(host, p.host[1:])
+	case strings.HasPrefix(p.host, "."):
+		return host == p.host[1:] || strings.HasSuffix(host, p.host)
+	}
+
+	return host == p.host
+}
+
+// splitHost splits a CONNECT target into a lowercase host and a port,
+// defaulting to 443
+func splitHost(hostport string) (string, string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "443"
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, ".")), port
+}
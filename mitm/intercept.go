@@ -0,0 +1,156 @@
+package mitm
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const handshakeTimeout = time.Second * 10
+
+// intercept terminates tls for a CONNECT request and serves the decrypted
+// requests with the wrapped handler
+func (h *mitmHandler) intercept(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	span := startSpan(req, "intercept")
+	defer span.End()
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		log.Println("connection doesn't support hijacking")
+		http.Error(rw, "connection doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	local, buffered, err := hj.Hijack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	local.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	h.serveTLS(req, &bufferedConn{Conn: local, r: buffered.Reader}, start, span)
+}
+
+// InterceptConn terminates tls on a connection that was redirected to the
+// proxy rather than sent via CONNECT, hostport is what the client asked for
+func (h *mitmHandler) InterceptConn(conn net.Conn, hostport string) {
+	req := connectRequest(conn, hostport)
+	start := time.Now()
+	span := startSpan(req, "intercept")
+	defer span.End()
+
+	h.serveTLS(req, conn, start, span)
+}
+
+func (h *mitmHandler) serveTLS(req *http.Request, local net.Conn, start time.Time, span trace.Span) {
+	conn := tls.Server(local, h.serverConfig(req.URL.Host))
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+
+	if err != nil {
+		log.Printf("tls handshake with client for %s failed: %s", req.URL.Host, err.Error())
+		h.logConnect(req, start, http.StatusBadGateway, 0, "INTERCEPT")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	state := conn.ConnectionState()
+	span.SetAttributes(
+		attribute.String("tls.protocol.version", tls.VersionName(state.Version)),
+		attribute.String("network.protocol.name", state.NegotiatedProtocol),
+	)
+
+	l := newConnListener(conn)
+	srv := &http.Server{
+		Handler:     h.upstream(req.URL.Host),
+		IdleTimeout: h.idleTimeout,
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+
+	srv.Serve(l)
+	h.logConnect(req, start, http.StatusOK, 0, "INTERCEPT")
+}
+
+// upstream turns decrypted requests back into absolute urls for the handler
+func (h *mitmHandler) upstream(hostport string) http.Handler {
+	host, port := splitHost(hostport)
+	if port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = host
+		}
+
+		h.handler.ServeHTTP(rw, req)
+	})
+}
+
+// bufferedConn reads anything buffered before the connection was hijacked
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener is a listener that accepts a single connection and blocks
+// until it's closed, so http.Server.Serve returns when the client is done.
+// The connection is kept as a *tls.Conn so the server can negotiate h2.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+		return conn, nil
+	}
+
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return dummyAddr("intercepted")
+}
+
+type dummyAddr string
+
+func (a dummyAddr) Network() string { return string(a) }
+func (a dummyAddr) String() string  { return string(a) }
@@ -0,0 +1,269 @@
+package mitm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"net"
+	"os"
+	f "path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	intermediateKeyFile  = "packageproxy-intermediate.key"
+	intermediateCertFile = "packageproxy-intermediate.crt"
+)
+
+// NameConstraints converts intercepted host patterns to the dns names and ip
+// ranges an intermediate CA is limited to. Ports are ignored.
+func NameConstraints(patterns []string) (dns []string, ips []*net.IPNet) {
+	seen := map[string]bool{}
+
+	for _, s := range patterns {
+		p := parseHostPattern(s)
+		host := p.host
+
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			ips = append(ips, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		// x509 constraints match the domain and its subdomains unless
+		// they start with a dot, which is the reverse of our patterns
+		switch {
+		case strings.HasPrefix(host, "*."):
+			host = host[1:]
+		case strings.HasPrefix(host, "."):
+			host = host[1:]
+		}
+
+		if !seen[host] {
+			seen[host] = true
+			dns = append(dns, host)
+		}
+	}
+
+	sort.Strings(dns)
+	return dns, ips
+}
+
+// excludedDomains returns the subdomains of exact host patterns, which their
+// permitted dns constraint would otherwise allow too, unless another pattern
+// permits them
+func excludedDomains(patterns, permitted []string) []string {
+	excluded := []string{}
+	seen := map[string]bool{}
+
+	for _, s := range patterns {
+		host := parseHostPattern(s).host
+		if strings.HasPrefix(host, ".") || strings.HasPrefix(host, "*.") ||
+			net.ParseIP(strings.Trim(host, "[]")) != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		covered := false
+		for _, c := range permitted {
+			if strings.HasSuffix(c, "."+host) || (c != host && matchConstraint(host, c)) {
+				covered = true
+			}
+		}
+
+		if !covered {
+			excluded = append(excluded, "."+host)
+		}
+	}
+
+	sort.Strings(excluded)
+	return excluded
+}
+
+// NewIntermediate generates a CA signed by root that can only issue
+// certificates for hosts matching patterns
+func (root *CA) NewIntermediate(subject pkix.Name, validity time.Duration, patterns []string) (*CA, error) {
+	dns, ips := NameConstraints(patterns)
+	if len(dns) == 0 && len(ips) == 0 {
+		return nil, errors.New("an intermediate ca needs at least one host to intercept")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(root.Cert.NotAfter) {
+		notAfter = root.Cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:                serial,
+		Subject:                     subject,
+		NotBefore:                   now.Add(-time.Hour),
+		NotAfter:                    notAfter,
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         dns,
+		ExcludedDNSDomains:          excludedDomains(patterns, dns),
+		PermittedIPRanges:           ips,
+	}
+
+	// without a permitted ip range, ip addresses aren't constrained at all
+	if len(ips) == 0 {
+		template.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, root.Cert, key.Public(), root.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{Cert: cert, Key: key, Root: root.Cert}, nil
+}
+
+// loadOrCreateIntermediate loads the intermediate in config.Dir, generating a
+// new one from the root if it's missing, expired or constrained to different
+// hosts
+func loadOrCreateIntermediate(config CAConfig) (*CA, error) {
+	root, err := LoadCA(config.RootKeyFile, config.RootCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile := f.Join(config.Dir, intermediateKeyFile)
+	certFile := f.Join(config.Dir, intermediateCertFile)
+
+	if cert, err := readCert(certFile); err == nil && time.Now().After(cert.NotAfter) {
+		log.Printf("intermediate ca %s expired on %s, regenerating it", certFile, cert.NotAfter)
+	} else if err == nil {
+		ca, err := LoadCA(keyFile, certFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if ca.Cert.CheckSignatureFrom(root.Cert) == nil && ca.constrainedTo(config.Permitted) {
+			ca.Root = root.Cert
+			return ca, nil
+		}
+
+		log.Printf("intercepted hosts or root changed, regenerating intermediate ca")
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("generating new intermediate ca in %s", config.Dir)
+	ca, err := root.NewIntermediate(config.Subject, config.Validity, config.Permitted)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ca.Save(keyFile, certFile); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+func (ca *CA) constrainedTo(patterns []string) bool {
+	dns, ips := NameConstraints(patterns)
+	existing := append([]string{}, ca.Cert.PermittedDNSDomains...)
+	sort.Strings(existing)
+	excluded := append([]string{}, ca.Cert.ExcludedDNSDomains...)
+	sort.Strings(excluded)
+
+	return reflect.DeepEqual(dns, existing) &&
+		reflect.DeepEqual(excludedDomains(patterns, dns), excluded) &&
+		reflect.DeepEqual(ipStrings(ips), ipStrings(ca.Cert.PermittedIPRanges))
+}
+
+func ipStrings(ips []*net.IPNet) []string {
+	s := []string{}
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	sort.Strings(s)
+	return s
+}
+
+// Permits returns whether the CA's name constraints allow issuing a
+// certificate for host
+func (ca *CA) Permits(host string) bool {
+	cert := ca.Cert
+	if len(cert.PermittedDNSDomains) == 0 && len(cert.ExcludedDNSDomains) == 0 &&
+		len(cert.PermittedIPRanges) == 0 && len(cert.ExcludedIPRanges) == 0 {
+		return true
+	}
+
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		for _, r := range cert.ExcludedIPRanges {
+			if r.Contains(ip) {
+				return false
+			}
+		}
+		if len(cert.PermittedIPRanges) == 0 {
+			return true
+		}
+		for _, r := range cert.PermittedIPRanges {
+			if r.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, c := range cert.ExcludedDNSDomains {
+		if matchConstraint(host, c) {
+			return false
+		}
+	}
+
+	if len(cert.PermittedDNSDomains) == 0 {
+		return true
+	}
+
+	for _, c := range cert.PermittedDNSDomains {
+		if matchConstraint(host, c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchConstraint(host, constraint string) bool {
+	host, constraint = strings.ToLower(host), strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+
+	return host == constraint || strings.HasSuffix(host, "."+constraint)
+}
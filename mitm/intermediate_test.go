@@ -0,0 +1,157 @@
+package mitm
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testPatterns = []string{"registry.npmjs.org:443", "*.rubygems.org", ".packagist.org"}
+
+func TestNameConstraintsFromPatterns(t *testing.T) {
+	dns, ips := NameConstraints(append(testPatterns, "10.0.0.1"))
+
+	if expected := []string{".rubygems.org", "packagist.org", "registry.npmjs.org"}; !reflect.DeepEqual(dns, expected) {
+		t.Fatalf("Expected %v, got %v", expected, dns)
+	}
+
+	if len(ips) != 1 || ips[0].String() != "10.0.0.1/32" {
+		t.Fatalf("Unexpected ip ranges %v", ips)
+	}
+}
+
+func TestIntermediateOnlyIssuesForPermittedHosts(t *testing.T) {
+	root, err := NewCA(pkix.Name{CommonName: "Test Root"}, time.Hour*24)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := root.NewIntermediate(pkix.Name{CommonName: "Test Intermediate"}, time.Hour, testPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Cert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(ca.Cert)
+
+	for host, permitted := range map[string]bool{
+		"registry.npmjs.org":   true,
+		"a.registry.npmjs.org": false,
+		"index.rubygems.org":   true,
+		"rubygems.org":         false,
+		"packagist.org":        true,
+		"repo.packagist.org":   true,
+		"github.com":           false,
+		"127.0.0.1":            false,
+		"evilregistry.npmjs.x": false,
+	} {
+		if ca.Permits(host) != permitted {
+			t.Errorf("Expected Permits(%q) to be %v", host, permitted)
+		}
+
+		leaf, err := ca.Leaf(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = leaf.Leaf.Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if (err == nil) != permitted {
+			t.Errorf("Expected verifying %q to be %v, got %v", host, permitted, err)
+		}
+	}
+
+	if ca.Trusted() != root.Cert {
+		t.Fatal("Expected clients to trust the root")
+	}
+}
+
+func TestExactHostsExcludeTheirSubdomains(t *testing.T) {
+	patterns := []string{"registry.npmjs.org", "rubygems.org", "*.rubygems.org", "repo.packagist.org", ".packagist.org"}
+	dns, _ := NameConstraints(patterns)
+
+	if excluded := excludedDomains(patterns, dns); !reflect.DeepEqual(excluded, []string{".registry.npmjs.org"}) {
+		t.Fatalf("Expected only subdomains no pattern permits to be excluded, got %v", excluded)
+	}
+}
+
+func TestIntermediateIsRegeneratedWhenHostsChange(t *testing.T) {
+	dir := t.TempDir()
+	root, _ := NewCA(pkix.Name{CommonName: "Test Root"}, time.Hour*24)
+	if err := root.Save(filepath.Join(dir, "root.key"), filepath.Join(dir, "root.crt")); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CAConfig{
+		Dir:          filepath.Join(dir, "certs"),
+		Validity:     time.Hour,
+		RootKeyFile:  root.KeyFile,
+		RootCertFile: root.CertFile,
+		Permitted:    testPatterns,
+	}
+
+	first, err := LoadOrCreateCA(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := LoadOrCreateCA(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.Cert.SerialNumber.Cmp(first.Cert.SerialNumber) != 0 {
+		t.Fatal("Expected the stored intermediate to be reused")
+	}
+
+	config.Permitted = []string{"registry.npmjs.org"}
+	changed, err := LoadOrCreateCA(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed.Cert.SerialNumber.Cmp(first.Cert.SerialNumber) == 0 {
+		t.Fatal("Expected a new intermediate for different hosts")
+	}
+}
+
+func TestExpiredIntermediateIsRegenerated(t *testing.T) {
+	dir := t.TempDir()
+	root, _ := NewCA(pkix.Name{CommonName: "Test Root"}, time.Hour*24)
+	if err := root.Save(filepath.Join(dir, "root.key"), filepath.Join(dir, "root.crt")); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CAConfig{
+		Dir:          filepath.Join(dir, "certs"),
+		Validity:     time.Hour,
+		RootKeyFile:  root.KeyFile,
+		RootCertFile: root.CertFile,
+		Permitted:    testPatterns,
+	}
+
+	expired, err := root.NewIntermediate(pkix.Name{CommonName: "Expired"}, -time.Minute*30, testPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expired.Save(filepath.Join(config.Dir, intermediateKeyFile), filepath.Join(config.Dir, intermediateCertFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := LoadOrCreateCA(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ca.Cert.NotAfter.After(time.Now()) {
+		t.Fatalf("Expected a new intermediate, got one expiring %s", ca.Cert.NotAfter)
+	}
+}
@@ -2,64 +2,166 @@ package mitm
 
 import (
 	"crypto/tls"
-	"io"
+	"errors"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"time"
 
-	gomitm "github.com/getlantern/go-mitm/mitm"
+	"github.com/lox/package-proxy/accesslog"
+	"github.com/lox/package-proxy/metrics"
+	"github.com/lox/package-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// default set of TLS cipher suites used
-func defaultTlsConfig() *tls.Config {
-	return &tls.Config{
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
-			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
-			tls.TLS_RSA_WITH_RC4_128_SHA,
-			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-		},
-		PreferServerCipherSuites: true,
-	}
+var tracer = tracing.Tracer("mitm")
+
+// startSpan starts a span for a CONNECT request, continuing any incoming trace
+func startSpan(req *http.Request, mode string) trace.Span {
+	_, span := tracer.Start(tracing.Extract(req), "mitm.CONNECT",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("mitm.mode", mode),
+		),
+	)
+	return span
 }
 
+const (
+	defaultIdleTimeout = time.Minute * 5
+	defaultDialTimeout = time.Second * 30
+)
+
 // InterceptTlsHandler intercepts CONNECT requests and transparently decrypts them
-// using a generated certificate
-func InterceptTlsHandler(handler http.Handler, pkFile, certFile string) (*mitmHandler, error) {
-	cryptoConfig := &gomitm.CryptoConfig{
-		PKFile:          pkFile,
-		CertFile:        certFile,
-		ServerTLSConfig: defaultTlsConfig(),
+// using certificates generated by the CA
+func InterceptTlsHandler(handler http.Handler, ca *CA, config TLSConfig) (*mitmHandler, error) {
+	if ca == nil {
+		return nil, errors.New("a ca is required for tls interception")
 	}
 
-	wrapped, err := gomitm.Wrap(handler, cryptoConfig)
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	} else if config.MinVersion < tls.VersionTLS12 {
+		return nil, errors.New("tls versions before 1.2 aren't supported")
+	}
+
+	certs, err := NewCertStore(ca, "")
 	if err != nil {
 		return nil, err
 	}
 
 	return &mitmHandler{
-		handler: handler, wrapped: wrapped, hosts: []string{},
+		handler:     handler,
+		hosts:       []hostPattern{},
+		certs:       certs,
+		alpn:        newAlpnCache(),
+		tlsConfig:   config,
+		idleTimeout: defaultIdleTimeout,
+		dialTimeout: defaultDialTimeout,
 	}, nil
 }
 
 type mitmHandler struct {
-	handler, wrapped http.Handler
-	hosts            []string
+	handler     http.Handler
+	hosts       []hostPattern
+	certs       *CertStore
+	alpn        *alpnCache
+	tlsConfig   TLSConfig
+	accessLog   accesslog.Logger
+	idleTimeout time.Duration
+	dialTimeout time.Duration
 }
 
+// AddHost intercepts CONNECT requests for hosts matching a pattern, which is
+// either an exact host, "*.example.org" or ".example.org" with an optional port
 func (h *mitmHandler) AddHost(host string) {
-	h.hosts = append(h.hosts, host)
+	h.hosts = append(h.hosts, parseHostPattern(host))
+}
+
+// SetAccessLog sets where CONNECT requests are logged
+func (h *mitmHandler) SetAccessLog(l accesslog.Logger) {
+	h.accessLog = l
 }
 
-func (h *mitmHandler) match(host string) bool {
-	for _, h := range h.hosts {
-		if h == host {
+// SetCertStore sets where generated leaf certificates are kept
+func (h *mitmHandler) SetCertStore(s *CertStore) {
+	h.certs = s
+}
+
+// SetUpstreamTLS sets how tls connections to intercepted upstream hosts are
+// configured
+func (h *mitmHandler) SetUpstreamTLS(config func(hostport string) *tls.Config) {
+	h.alpn.config = config
+}
+
+// SetIdleTimeout sets how long a passthrough tunnel can be idle before it's closed
+func (h *mitmHandler) SetIdleTimeout(d time.Duration) {
+	h.idleTimeout = d
+}
+
+func (h *mitmHandler) logConnect(req *http.Request, start time.Time, status int, bytes int64, result string) {
+	if h.accessLog == nil {
+		return
+	}
+
+	h.accessLog.Log(&accesslog.Entry{
+		Time:         start,
+		ClientIP:     accesslog.ClientIP(req.RemoteAddr),
+		Method:       req.Method,
+		URL:          req.URL.Host,
+		Proto:        req.Proto,
+		Status:       status,
+		Bytes:        bytes,
+		Duration:     time.Since(start),
+		CacheResult:  result,
+		UpstreamHost: req.URL.Host,
+		UserAgent:    req.UserAgent(),
+	})
+}
+
+// connectRequest describes a redirected connection as a CONNECT request for
+// logging and tracing
+func connectRequest(conn net.Conn, hostport string) *http.Request {
+	return &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: hostport},
+		Host:       hostport,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+}
+
+// Match returns whether CONNECTs to hostport are intercepted
+func (h *mitmHandler) Match(hostport string) bool {
+	return h.intercepts(hostport)
+}
+
+// intercepts checks a host matches and the CA is allowed to issue for it
+func (h *mitmHandler) intercepts(hostport string) bool {
+	if !h.match(hostport) {
+		return false
+	}
+
+	if host, _ := splitHost(hostport); !h.certs.ca.Permits(host) {
+		log.Printf("not intercepting %s, it's outside the ca's name constraints", hostport)
+		return false
+	}
+
+	return true
+}
+
+func (h *mitmHandler) match(hostport string) bool {
+	host, port := splitHost(hostport)
+
+	for _, p := range h.hosts {
+		if p.match(host, port) {
 			return true
 		}
 	}
@@ -67,45 +169,96 @@ func (h *mitmHandler) match(host string) bool {
 	return false
 }
 
+// connectProxy tunnels a CONNECT request to its destination without interception
 func (h *mitmHandler) connectProxy(rw http.ResponseWriter, req *http.Request) {
-	remote, err := net.Dial("tcp", req.URL.Host)
+	start := time.Now()
+	span := startSpan(req, "tunnel")
+	defer span.End()
+
+	remote, err := net.DialTimeout("tcp", req.URL.Host, h.dialTimeout)
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		log.Printf("error connecting to %s: %s", req.URL.Host, err.Error())
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		h.logConnect(req, start, http.StatusBadGateway, 0, "TUNNEL")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return
 	}
 
 	hj, ok := rw.(http.Hijacker)
 	if !ok {
 		log.Println("connection doesn't support hijacking")
+		http.Error(rw, "connection doesn't support hijacking", http.StatusInternalServerError)
+		remote.Close()
 		return
 	}
-	local, _, err := hj.Hijack()
+
+	local, buffered, err := hj.Hijack()
 	if err != nil {
 		log.Println(err)
+		remote.Close()
 		return
 	}
 
-	local.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+	local.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	// anything the client sent early is sitting in the hijacked buffer
+	if n := buffered.Reader.Buffered(); n > 0 {
+		early, _ := buffered.Reader.Peek(n)
+		remote.Write(early)
+	}
+
+	h.tunnel(req, local, remote, start, span)
+}
+
+// TunnelConn tunnels a connection that was redirected to the proxy to addr
+// without interception, hostport is what the client asked for
+func (h *mitmHandler) TunnelConn(local net.Conn, hostport, addr string) {
+	req := connectRequest(local, hostport)
+	start := time.Now()
+	span := startSpan(req, "tunnel")
+	defer span.End()
 
-	go io.Copy(local, remote)
-	go func() {
-		io.Copy(remote, local)
+	remote, err := net.DialTimeout("tcp", addr, h.dialTimeout)
+	if err != nil {
+		log.Printf("error connecting to %s: %s", addr, err.Error())
 		local.Close()
-		remote.Close()
-	}()
+		h.logConnect(req, start, http.StatusBadGateway, 0, "TUNNEL")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	h.tunnel(req, local, remote, start, span)
+}
+
+func (h *mitmHandler) tunnel(req *http.Request, local, remote net.Conn, start time.Time, span trace.Span) {
+	metrics.Tunnels.Inc()
+	defer metrics.Tunnels.Dec()
+
+	sent, received, err := Tunnel(local, remote, h.idleTimeout)
+	if err != nil {
+		log.Printf("tunnel to %s closed: %s", req.URL.Host, err.Error())
+		span.RecordError(err)
+	}
+
+	h.logConnect(req, start, http.StatusOK, sent, "TUNNEL")
+	span.SetAttributes(
+		attribute.Int64("mitm.bytes_sent", sent),
+		attribute.Int64("mitm.bytes_received", received),
+	)
 }
 
 func (h *mitmHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	h.wrapped.ServeHTTP(rw, req)
-	// if req.Method == "CONNECT" {
-	// 	if h.match(req.URL.Host) {
-	// 		log.Printf("intercepting CONNECT to %s", req.URL.Host)
-	// 		h.wrapped.ServeHTTP(rw, req)
-	// 	} else {
-	// 		log.Printf("%s \"CONNECT %s %s\"", req.RemoteAddr, req.URL.Host, req.Proto)
-	// 		h.connectProxy(rw, req)
-	// 	}
-	// } else {
-	// 	h.handler.ServeHTTP(rw, req)
-	// }
+	if req.Method != "CONNECT" {
+		h.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	if !h.intercepts(req.URL.Host) {
+		h.connectProxy(rw, req)
+		return
+	}
+
+	h.intercept(rw, req)
 }
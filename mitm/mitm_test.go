@@ -0,0 +1,213 @@
+package mitm
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHostMatching(t *testing.T) {
+	h := &mitmHandler{}
+	h.AddHost("registry.npmjs.org:443")
+	h.AddHost("*.rubygems.org")
+	h.AddHost(".packagist.org")
+
+	tests := map[string]bool{
+		"registry.npmjs.org:443":  true,
+		"registry.npmjs.org:8443": false,
+		"REGISTRY.npmjs.org:443":  true,
+		"npmjs.org:443":           false,
+		"index.rubygems.org:443":  true,
+		"a.b.rubygems.org:443":    true,
+		"rubygems.org:443":        false,
+		"packagist.org:443":       true,
+		"repo.packagist.org:443":  true,
+		"evilpackagist.org:443":   false,
+		"github.com:443":          false,
+	}
+
+	for host, expected := range tests {
+		if h.match(host) != expected {
+			t.Errorf("Expected match(%q) to be %v", host, expected)
+		}
+	}
+}
+
+func TestUnmatchedHostsAreTunnelled(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	proxy := httptest.NewServer(&mitmHandler{
+		idleTimeout: time.Second,
+		dialTimeout: time.Second,
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("CONNECT " + echo.Addr().String() + " HTTP/1.1\r\nHost: " + echo.Addr().String() + "\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 for CONNECT, got %d", resp.StatusCode)
+	}
+
+	conn.Write([]byte("llamas"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "llamas" {
+		t.Fatalf("Expected tunnel to echo llamas, got %q", body)
+	}
+}
+
+func TestTunnelDialErrorsReturnBadGateway(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("CONNECT", "http://"+addr, nil)
+	req.URL.Host = addr
+
+	h := &mitmHandler{dialTimeout: time.Second}
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502 for a failed dial, got %d", rw.Code)
+	}
+}
+
+func TestInterceptedHostsNegotiateModernTls(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.NotFoundHandler())
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	upstreamUrl, _ := url.Parse(upstream.URL)
+
+	ca, err := NewCA(pkix.Name{CommonName: "Test CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "%s %s", req.Proto, req.URL.String())
+	})
+
+	h, err := InterceptTlsHandler(handler, ca, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AddHost(upstreamUrl.Host)
+	h.SetUpstreamTLS(func(string) *tls.Config {
+		return upstream.Client().Transport.(*http.Transport).TLSClientConfig
+	})
+
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyUrl),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := client.Get(upstream.URL + "/llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if expected := "HTTP/2.0 " + upstream.URL + "/llamas"; string(body) != expected {
+		t.Fatalf("Expected %q, got %q", expected, body)
+	}
+
+	if resp.TLS.Version < tls.VersionTLS12 {
+		t.Fatalf("Expected at least tls 1.2, got %s", tls.VersionName(resp.TLS.Version))
+	}
+
+	if _, ok := resp.TLS.PeerCertificates[0].PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Fatalf("Expected an ecdsa leaf certificate")
+	}
+}
+
+func TestInterceptRejectsOldTlsVersions(t *testing.T) {
+	ca, err := NewCA(pkix.Name{CommonName: "Test CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InterceptTlsHandler(http.NotFoundHandler(), ca, TLSConfig{MinVersion: tls.VersionTLS11}); err == nil {
+		t.Fatal("Expected tls 1.1 to be rejected")
+	}
+}
+
+func TestFailedAlpnProbesAreRemembered(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostport := l.Addr().String()
+	l.Close()
+
+	probes := 0
+	a := newAlpnCache()
+	a.config = func(string) *tls.Config {
+		probes++
+		return &tls.Config{}
+	}
+
+	for i := 0; i < 3; i++ {
+		if a.supportsH2(hostport) {
+			t.Fatal("Expected an unreachable host not to support h2")
+		}
+	}
+
+	if probes != 1 {
+		t.Fatalf("Expected one probe of an unreachable host, got %d", probes)
+	}
+}
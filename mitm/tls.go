@@ -0,0 +1,154 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const probeTimeout = time.Second * 5
+
+// probeRetry is how long a failed probe is remembered before trying again
+const probeRetry = time.Minute
+
+// TLSConfig controls what intercepted clients can negotiate
+type TLSConfig struct {
+	// MinVersion defaults to TLS 1.2
+	MinVersion uint16
+
+	// CurvePreferences defaults to go's own preferences
+	CurvePreferences []tls.CurveID
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// ParseTLSVersion parses a minimum version like "1.2" or "1.3"
+func ParseTLSVersion(s string) (uint16, error) {
+	if v, ok := tlsVersions[strings.TrimPrefix(s, "tls")]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version %q, use 1.2 or 1.3", s)
+}
+
+// ParseCurves parses a list of curve names like X25519, P256, P384
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	ids := []tls.CurveID{}
+	for _, name := range names {
+		id, ok := curves[strings.ToLower(strings.Replace(name, "-", "", -1))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// serverConfig builds the config presented to intercepted clients. Leaf
+// certificates are generated per server name and h2 is only offered if the
+// upstream negotiates it too.
+func (h *mitmHandler) serverConfig(hostport string) *tls.Config {
+	host, port := splitHost(hostport)
+
+	return &tls.Config{
+		MinVersion:       h.tlsConfig.MinVersion,
+		CurvePreferences: h.tlsConfig.CurvePreferences,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			// only trust the server name if it's a host we'd intercept anyway
+			name := host
+			if sni := strings.ToLower(hello.ServerName); sni != "" && h.intercepts(net.JoinHostPort(sni, port)) {
+				name = sni
+			}
+
+			cert, err := h.certs.Get(name)
+			if err != nil {
+				return nil, err
+			}
+
+			protos := []string{"http/1.1"}
+			if h.alpn.supportsH2(hostport) {
+				protos = []string{"h2", "http/1.1"}
+			}
+
+			return &tls.Config{
+				MinVersion:       h.tlsConfig.MinVersion,
+				CurvePreferences: h.tlsConfig.CurvePreferences,
+				Certificates:     []tls.Certificate{*cert},
+				NextProtos:       protos,
+			}, nil
+		},
+	}
+}
+
+// alpnCache remembers whether upstream hosts negotiate h2, and which hosts
+// failed to be probed so handshakes to them aren't held up by every probe
+type alpnCache struct {
+	sync.Mutex
+	h2     map[string]bool
+	failed map[string]time.Time
+	config func(hostport string) *tls.Config
+}
+
+func newAlpnCache() *alpnCache {
+	return &alpnCache{h2: map[string]bool{}, failed: map[string]time.Time{}}
+}
+
+func (a *alpnCache) supportsH2(hostport string) bool {
+	a.Lock()
+	h2, ok := a.h2[hostport]
+	failedAt, failed := a.failed[hostport]
+	a.Unlock()
+
+	if ok {
+		return h2
+	} else if failed && time.Since(failedAt) < probeRetry {
+		return false
+	}
+
+	config := &tls.Config{}
+	if a.config != nil {
+		config = a.config(hostport)
+	}
+
+	h2, err := probeH2(hostport, config)
+	if err != nil {
+		a.Lock()
+		a.failed[hostport] = time.Now()
+		a.Unlock()
+		return false
+	}
+
+	a.Lock()
+	a.h2[hostport] = h2
+	delete(a.failed, hostport)
+	a.Unlock()
+	return h2
+}
+
+// probeH2 checks the protocol an upstream negotiates using the same tls
+// config as fetches, so hosts that fail verification never offer h2
+func probeH2(hostport string, config *tls.Config) (bool, error) {
+	config = config.Clone()
+	config.NextProtos = []string{"h2", "http/1.1"}
+
+	dialer := &net.Dialer{Timeout: probeTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", hostport, config)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().NegotiatedProtocol == "h2", nil
+}
@@ -0,0 +1,125 @@
+package mitm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned when a tunnel is closed for being idle
+var ErrIdleTimeout = errors.New("tunnel idle timeout")
+
+// Tunnel copies bytes between local and remote until both sides have closed,
+// or neither side has sent anything for idleTimeout. Each side is half-closed
+// when the other finishes sending, so protocols that rely on a shutdown still
+// work. Both connections are closed when it returns.
+func Tunnel(local, remote net.Conn, idleTimeout time.Duration) (sent, received int64, err error) {
+	t := &tunnel{local: local, remote: remote, idleTimeout: idleTimeout}
+	t.touch()
+
+	var wg sync.WaitGroup
+	var errs [2]error
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		received, errs[0] = t.pipe(remote, local)
+	}()
+	go func() {
+		defer wg.Done()
+		sent, errs[1] = t.pipe(local, remote)
+	}()
+
+	wg.Wait()
+	local.Close()
+	remote.Close()
+
+	if atomic.LoadInt32(&t.timedOut) == 1 {
+		return sent, received, ErrIdleTimeout
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return sent, received, err
+		}
+	}
+
+	return sent, received, nil
+}
+
+type tunnel struct {
+	local, remote net.Conn
+	idleTimeout   time.Duration
+	timedOut      int32
+}
+
+// touch pushes back the idle deadline on both connections
+func (t *tunnel) touch() {
+	if t.idleTimeout <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(t.idleTimeout)
+	t.local.SetDeadline(deadline)
+	t.remote.SetDeadline(deadline)
+}
+
+// pipe copies src to dst, then half-closes dst
+func (t *tunnel) pipe(dst, src net.Conn) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch()
+			w, werr := dst.Write(buf[:n])
+			written += int64(w)
+			if werr != nil {
+				t.abort(werr)
+				return written, werr
+			}
+		}
+
+		if err == io.EOF {
+			closeWrite(dst)
+			return written, nil
+		} else if err != nil {
+			t.abort(err)
+			if isTimeout(err) || isClosed(err) {
+				return written, nil
+			}
+			return written, err
+		}
+	}
+}
+
+// abort closes both sides, so the other direction stops too
+func (t *tunnel) abort(err error) {
+	if isTimeout(err) {
+		atomic.StoreInt32(&t.timedOut, 1)
+	}
+
+	t.local.Close()
+	t.remote.Close()
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"net"
 	"net/http"
 
+	"github.com/lox/package-proxy/accesslog"
 	"github.com/lox/package-proxy/cache"
 )
 
@@ -12,4 +14,19 @@ type Config struct {
 	Cache     cache.Cache
 	Patterns  cache.CachePatternSlice
 	ServerId  string
+	AccessLog accesslog.Logger
+
+	// CacheHooks verify and find cached responses for package formats
+	CacheHooks []cache.Hook
+
+	// Local handles requests made directly to the proxy rather than through it
+	Local http.Handler
+
+	// PathHosts are the hosts that can be requested path-style, like
+	// apt-cacher-ng's /archive.ubuntu.com/ubuntu/dists/..., as globs
+	PathHosts []string
+
+	// PurgeAllowed are the networks allowed to send PURGE requests,
+	// defaults to loopback only
+	PurgeAllowed []*net.IPNet
 }
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/lox/package-proxy/accesslog"
+	"github.com/lox/package-proxy/cache"
+)
+
+const maxFailovers = 3
+
+// Failover is implemented by rewriters that can send a request elsewhere
+// when the host they rewrote it to fails
+type Failover interface {
+	// Failover is given a rewritten request that failed and the url it had
+	// before rewriting, it returns the url to retry or nil to give up
+	Failover(req *http.Request, original *url.URL, resp *http.Response, err error) *url.URL
+}
+
+// failoverTransport retries failed GET and HEAD requests with the urls
+// returned by rewriters that implement Failover
+type failoverTransport struct {
+	next      http.RoundTripper
+	rewriters []Failover
+}
+
+func newFailoverTransport(next http.RoundTripper, rewriters []Rewriter) http.RoundTripper {
+	t := &failoverTransport{next: next}
+	for _, r := range rewriters {
+		if f, ok := r.(Failover); ok {
+			t.rewriters = append(t.rewriters, f)
+		}
+	}
+
+	if len(t.rewriters) == 0 {
+		return next
+	}
+
+	return t
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return resp, err
+	}
+
+	original, perr := url.Parse(req.Header.Get(cache.CanonicalUrlHeader))
+	if perr != nil || !original.IsAbs() {
+		return resp, err
+	}
+
+	for i := 0; i < maxFailovers && failed(resp, err); i++ {
+		next := t.failover(req, original, resp, err)
+		if next == nil {
+			break
+		}
+
+		log.Printf("%s failed, retrying with %s", req.URL, next)
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		req = req.Clone(req.Context())
+		req.URL, req.Host = next, next.Host
+
+		if entry := accesslog.FromContext(req.Context()); entry != nil {
+			entry.UpstreamHost = next.Host
+		}
+
+		resp, err = t.next.RoundTrip(req)
+	}
+
+	return resp, err
+}
+
+func (t *failoverTransport) failover(req *http.Request, original *url.URL, resp *http.Response, err error) *url.URL {
+	for _, r := range t.rewriters {
+		if next := r.Failover(req, original, resp, err); next != nil {
+			return next
+		}
+	}
+
+	return nil
+}
+
+func failed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
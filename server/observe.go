@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Observer is implemented by rewriters that learn from the upstream requests
+// they rewrote, such as picking mirrors by their throughput
+type Observer interface {
+	// Observe is called once a request has finished with the bytes read from
+	// the response body and the time from sending the request, err is set if
+	// the request failed or returned a 5xx
+	Observe(req *http.Request, bytes int64, duration time.Duration, err error)
+}
+
+// observingTransport reports the result of every upstream request to the
+// rewriters that implement Observer
+type observingTransport struct {
+	next      http.RoundTripper
+	observers []Observer
+}
+
+func newObservingTransport(next http.RoundTripper, rewriters []Rewriter) http.RoundTripper {
+	t := &observingTransport{next: next}
+	for _, r := range rewriters {
+		if o, ok := r.(Observer); ok {
+			t.observers = append(t.observers, o)
+		}
+	}
+
+	if len(t.observers) == 0 {
+		return next
+	}
+
+	return t
+}
+
+func (t *observingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	if err != nil {
+		t.observe(req, 0, time.Since(start), err)
+		return resp, err
+	} else if resp.StatusCode >= 500 {
+		t.observe(req, 0, time.Since(start), fmt.Errorf("returned %s", resp.Status))
+		return resp, err
+	}
+
+	resp.Body = &observedBody{ReadCloser: resp.Body, done: func(n int64, err error) {
+		t.observe(req, n, time.Since(start), err)
+	}}
+
+	return resp, nil
+}
+
+func (t *observingTransport) observe(req *http.Request, bytes int64, duration time.Duration, err error) {
+	for _, o := range t.observers {
+		o.Observe(req, bytes, duration, err)
+	}
+}
+
+// observedBody counts the bytes read from a body and calls done once, when
+// it's read to the end, fails or is closed
+type observedBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64, err error)
+}
+
+func (b *observedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+
+	if err == io.EOF {
+		b.finish(nil)
+	} else if err != nil {
+		b.finish(err)
+	}
+
+	return n, err
+}
+
+func (b *observedBody) Close() error {
+	b.finish(nil)
+	return b.ReadCloser.Close()
+}
+
+func (b *observedBody) finish(err error) {
+	b.once.Do(func() {
+		b.done(b.n, err)
+	})
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// pathStyleUrl maps an apt-cacher-ng style request for /<host>/<path> to the
+// upstream url, if host is one of the allowed path hosts
+func (p *PackageProxy) pathStyleUrl(req *http.Request) (*url.URL, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || !p.isPathHost(parts[0]) {
+		return nil, false
+	}
+
+	return &url.URL{
+		Scheme:   "http",
+		Host:     parts[0],
+		Path:     "/" + parts[1],
+		RawQuery: req.URL.RawQuery,
+	}, true
+}
+
+// isPathHost checks a host matches a path host glob, hosts with a port
+// aren't allowed so path-style requests can't reach other services
+func (p *PackageProxy) isPathHost(host string) bool {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return false
+	}
+	host = strings.ToLower(host)
+
+	for _, pattern := range p.pathHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,18 +1,42 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"os"
+	"time"
 
+	"github.com/lox/package-proxy/accesslog"
 	"github.com/lox/package-proxy/cache"
+	"github.com/lox/package-proxy/metrics"
+	"github.com/lox/package-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("server")
+
 type PackageProxy struct {
 	Handler   http.Handler
 	Cache     cache.Cache
 	Transport *http.Transport
 	Rewriters []Rewriter
 	Patterns  cache.CachePatternSlice
+	AccessLog accesslog.Logger
+	Local     http.Handler
+	writes    waiter
+	purgers   []*net.IPNet
+	pathHosts []string
+}
+
+// waiter is implemented by transports that write to the cache in the background
+type waiter interface {
+	Wait(ctx context.Context) error
 }
 
 type Rewriter interface {
@@ -26,6 +50,15 @@ func (f RewriterFunc) Rewrite(req *http.Request) {
 	f(req)
 }
 
+// rewriterName returns a name for a rewriter for logging
+func rewriterName(r Rewriter) string {
+	if s, ok := r.(fmt.Stringer); ok {
+		return s.String()
+	}
+
+	return fmt.Sprintf("%T", r)
+}
+
 func applyConfigDefaults(config *Config) error {
 	if config.Upstream == nil {
 		config.Upstream = &http.Transport{}
@@ -39,6 +72,18 @@ func applyConfigDefaults(config *Config) error {
 		config.ServerId = "package-proxy"
 	}
 
+	if config.PurgeAllowed == nil {
+		config.PurgeAllowed = loopbackNets
+	}
+
+	if config.AccessLog == nil {
+		logger, err := accesslog.New(os.Stdout, accesslog.FormatCombined)
+		if err != nil {
+			return err
+		}
+		config.AccessLog = logger
+	}
+
 	if config.Cache == nil {
 		cache, err := cache.NewDiskCache("", 1<<20)
 		if err != nil {
@@ -55,23 +100,45 @@ func NewPackageProxy(config *Config) (*PackageProxy, error) {
 		return nil, err
 	}
 
+	transport := cache.CachedRoundTripper(
+		config.Cache,
+		newFailoverTransport(newObservingTransport(config.Upstream, config.Rewriters), config.Rewriters),
+		config.ServerId,
+		config.CacheHooks...,
+	)
+
 	proxy := &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
 			// strip conditional request headers
 			r.Header.Del("If-Modified-Since")
 			r.Header.Del("If-Match")
 
+			_, span := tracer.Start(r.Context(), "rewrite")
+			defer span.End()
+
+			entry := accesslog.FromContext(r.Context())
+
 			// these get applied to the upstream request
 			for _, rewrite := range config.Rewriters {
+				before := r.URL.String()
 				rewrite.Rewrite(r)
+
+				if entry != nil && r.URL.String() != before {
+					entry.Rewriter = rewriterName(rewrite)
+				}
 			}
 
 			// reset host header
 			r.Host = r.URL.Host
+
+			if entry != nil {
+				entry.UpstreamHost = r.URL.Host
+				span.SetAttributes(attribute.String("rewriter", entry.Rewriter))
+			}
+
+			span.SetAttributes(attribute.String("server.address", r.URL.Host))
 		},
-		Transport: cache.CachedRoundTripper(
-			config.Cache, config.Upstream, config.ServerId,
-		),
+		Transport: transport,
 	}
 
 	var handler http.Handler
@@ -82,15 +149,208 @@ func NewPackageProxy(config *Config) (*PackageProxy, error) {
 		Cache:     config.Cache,
 		Rewriters: config.Rewriters,
 		Patterns:  config.Patterns,
+		AccessLog: config.AccessLog,
+		Local:     config.Local,
+		writes:    transport,
+		purgers:   config.PurgeAllowed,
+		pathHosts: config.PathHosts,
 	}, nil
 }
 
 func (p *PackageProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// path-style requests share cache entries with proxied ones
+	if !req.URL.IsAbs() {
+		if u, ok := p.pathStyleUrl(req); ok {
+			req.URL, req.Host = u, u.Host
+		}
+	}
+
+	entry := &accesslog.Entry{
+		Time:         time.Now(),
+		ClientIP:     accesslog.ClientIP(req.RemoteAddr),
+		Method:       req.Method,
+		URL:          req.URL.String(),
+		CanonicalURL: p.canonicalUrl(req),
+		Proto:        req.Proto,
+		Referer:      req.Referer(),
+		UserAgent:    req.UserAgent(),
+	}
+
+	ctx, span := tracer.Start(tracing.Extract(req), "PackageProxy.ServeHTTP",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", entry.URL),
+		),
+	)
+	defer span.End()
+
+	w := &responseWriter{ResponseWriter: rw}
+	defer p.logRequest(entry, w, span)
+
+	if req.Method == "PURGE" {
+		entry.CacheResult = "PURGE"
+		p.purge(w, req)
+		return
+	}
+
+	// requests made directly to the proxy aren't absolute
+	if !req.URL.IsAbs() {
+		entry.CacheResult = "LOCAL"
+		p.serveLocal(w, req)
+		return
+	}
+
 	match, pattern := p.Patterns.MatchString(req.URL.String())
 	if match {
 		req.Header.Set(cache.MaxAgeHeader, pattern.Duration.String())
+		entry.Rule = pattern.String()
+	}
+
+	req.Header.Set(cache.CanonicalUrlHeader, entry.CanonicalURL)
+	req = req.WithContext(accesslog.NewContext(ctx, entry))
+
+	p.Handler.ServeHTTP(w, req)
+	recordMetrics(w, pattern)
+}
+
+func (p *PackageProxy) serveLocal(rw http.ResponseWriter, req *http.Request) {
+	if p.Local == nil {
+		http.Error(rw, "this is a proxy server, requests must be absolute", http.StatusBadRequest)
+		return
+	}
+
+	p.Local.ServeHTTP(rw, req)
+}
+
+func (p *PackageProxy) logRequest(entry *accesslog.Entry, w *responseWriter, span trace.Span) {
+	entry.Status = w.status
+	entry.Bytes = w.bytes
+	entry.Duration = time.Since(entry.Time)
+	if entry.CacheResult == "" {
+		entry.CacheResult = w.cacheResult()
+	}
+	p.AccessLog.Log(entry)
+
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", entry.Status),
+		attribute.String("cache.result", entry.CacheResult),
+		attribute.String("cache.rule", entry.Rule),
+	)
+}
+
+func recordMetrics(w *responseWriter, pattern *cache.CachePattern) {
+	label := "none"
+	if pattern != nil {
+		label = pattern.String()
+	}
+
+	result := w.cacheResult()
+	metrics.Requests.WithLabelValues(result, label).Inc()
+
+	if result == "HIT" {
+		metrics.BytesServed.WithLabelValues("cache").Add(float64(w.bytes))
+	} else {
+		metrics.BytesServed.WithLabelValues("upstream").Add(float64(w.bytes))
+	}
+}
+
+// Shutdown waits for in-flight cache writes until the context is done, then
+// closes the cache. The cache is closed even if the deadline is exceeded.
+func (p *PackageProxy) Shutdown(ctx context.Context) error {
+	if err := p.writes.Wait(ctx); err != nil {
+		log.Printf("gave up waiting for cache writes: %s", err.Error())
+	}
+
+	return p.Cache.Close()
+}
+
+// Canonicalizer is implemented by rewriters that know when the same file is
+// served from different urls, so that it's only cached once
+type Canonicalizer interface {
+	Canonical(u *url.URL) (string, bool)
+}
+
+// canonicalUrl returns the url a request is cached under, before rewriting
+func (p *PackageProxy) canonicalUrl(req *http.Request) string {
+	for _, r := range p.Rewriters {
+		if c, ok := r.(Canonicalizer); ok {
+			if u, ok := c.Canonical(req.URL); ok {
+				return u
+			}
+		}
+	}
+
+	return req.URL.String()
+}
+
+var loopbackNets = []*net.IPNet{
+	{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+}
+
+// ParseNets parses a list of CIDRs or bare IP addresses
+func ParseNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func (p *PackageProxy) isPurgeAllowed(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range p.purgers {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// purge evicts the cached response for a url, squid/varnish style
+func (p *PackageProxy) purge(rw http.ResponseWriter, req *http.Request) {
+	if !p.isPurgeAllowed(req) {
+		log.Printf("%s denied PURGE %s", req.RemoteAddr, req.URL)
+		http.Error(rw, "purge not allowed", http.StatusForbidden)
+		return
+	}
+
+	u := p.canonicalUrl(req)
+	err := p.Cache.Delete(cache.Key(u))
+	if err == cache.ErrNotFound {
+		http.Error(rw, fmt.Sprintf("%s not in cache", u), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	req.Header.Set("X-Canonical-Url", req.URL.String())
-	p.Handler.ServeHTTP(rw, req)
+	log.Printf("%s purged %s", req.RemoteAddr, u)
+	fmt.Fprintf(rw, "purged %s\n", u)
 }
@@ -0,0 +1,114 @@
+package setup
+
+import "text/template"
+
+// header downloads the CA to $CA_FILE when interception is enabled, and
+// appends it to a copy of the system bundle in $CA_BUNDLE. Clients that only
+// trust one file use the bundle, as hosts that aren't intercepted are
+// tunnelled with their own certificates.
+const header = `#!/bin/sh
+# generated by package-proxy for {{.ProxyURL}}
+{{- if .MitmHosts}}
+# tls is intercepted for:{{range .MitmHosts}} {{.}}{{end}}
+{{- end}}
+set -e
+
+PROXY_URL="{{.ProxyURL}}"
+{{- if .HasCA}}
+CA_FILE="${CA_FILE:-$HOME/.package-proxy/ca.crt}"
+CA_BUNDLE="${CA_BUNDLE:-$HOME/.package-proxy/ca-bundle.crt}"
+
+mkdir -p "$(dirname "$CA_FILE")" "$(dirname "$CA_BUNDLE")"
+curl -fsS -o "$CA_FILE" "{{.CAURL}}"
+echo "installed package-proxy ca to $CA_FILE"
+
+if [ -z "$SYSTEM_CA_FILE" ]; then
+  for f in /etc/ssl/certs/ca-certificates.crt /etc/pki/tls/certs/ca-bundle.crt /etc/ssl/ca-bundle.pem /etc/ssl/cert.pem; do
+    if [ -f "$f" ]; then
+      SYSTEM_CA_FILE="$f"
+      break
+    fi
+  done
+fi
+if [ ! -f "$SYSTEM_CA_FILE" ]; then
+  echo "no system ca bundle found, set SYSTEM_CA_FILE" >&2
+  exit 1
+fi
+cat "$SYSTEM_CA_FILE" "$CA_FILE" > "$CA_BUNDLE"
+echo "installed $SYSTEM_CA_FILE and the package-proxy ca to $CA_BUNDLE"
+{{- end}}
+`
+
+// rootHeader installs the CA into the debian/ubuntu system trust store
+const rootHeader = `#!/bin/sh
+# generated by package-proxy for {{.ProxyURL}}, run as root
+{{- if .MitmHosts}}
+# tls is intercepted for:{{range .MitmHosts}} {{.}}{{end}}
+{{- end}}
+set -e
+{{- if .HasCA}}
+
+curl -fsS -o /usr/local/share/ca-certificates/package-proxy.crt "{{.CAURL}}"
+update-ca-certificates
+{{- end}}
+`
+
+var scripts = map[string]*template.Template{
+	"ubuntu": template.Must(template.New("ubuntu").Parse(rootHeader + `
+cat > /etc/apt/apt.conf.d/01package-proxy <<APTCONF
+Acquire::http::Proxy "{{.ProxyURL}}/";
+Acquire::https::Proxy "{{.ProxyURL}}/";
+APTCONF
+echo "apt configured to use {{.ProxyURL}}"
+`)),
+
+	"npm": template.Must(template.New("npm").Parse(header + `
+npm config set proxy "$PROXY_URL"
+npm config set https-proxy "$PROXY_URL"
+echo "npm configured to use $PROXY_URL"
+{{- if .HasCA}}
+echo "node trusts the package-proxy ca with NODE_EXTRA_CA_CERTS, add this to your shell profile:"
+echo "  export NODE_EXTRA_CA_CERTS=$CA_FILE"
+{{- end}}
+`)),
+
+	"gem": template.Must(template.New("gem").Parse(header + `
+touch "$HOME/.gemrc"
+grep -q '^http_proxy:' "$HOME/.gemrc" || echo "http_proxy: $PROXY_URL" >> "$HOME/.gemrc"
+{{- if .HasCA}}
+grep -q '^:ssl_ca_cert:' "$HOME/.gemrc" || echo ":ssl_ca_cert: $CA_BUNDLE" >> "$HOME/.gemrc"
+if command -v bundle >/dev/null; then
+  bundle config set --global ssl_ca_cert "$CA_BUNDLE"
+fi
+{{- end}}
+echo "rubygems configured to use $PROXY_URL, bundler uses http_proxy:"
+echo "  export http_proxy=$PROXY_URL https_proxy=$PROXY_URL"
+`)),
+
+	"composer": template.Must(template.New("composer").Parse(header + `
+{{- if .HasCA}}
+composer config --global cafile "$CA_BUNDLE"
+{{- end}}
+echo "composer uses http_proxy, add this to your shell profile:"
+echo "  export http_proxy=$PROXY_URL https_proxy=$PROXY_URL"
+`)),
+
+	"pip": template.Must(template.New("pip").Parse(header + `
+pip config set global.proxy "$PROXY_URL"
+{{- if .HasCA}}
+pip config set global.cert "$CA_BUNDLE"
+{{- end}}
+echo "pip configured to use $PROXY_URL"
+`)),
+
+	"docker": template.Must(template.New("docker").Parse(rootHeader + `
+mkdir -p /etc/systemd/system/docker.service.d
+cat > /etc/systemd/system/docker.service.d/package-proxy.conf <<UNIT
+[Service]
+Environment="HTTP_PROXY={{.ProxyURL}}" "HTTPS_PROXY={{.ProxyURL}}"
+UNIT
+systemctl daemon-reload
+systemctl restart docker
+echo "docker daemon configured to use {{.ProxyURL}}"
+`)),
+}
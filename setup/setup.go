@@ -0,0 +1,179 @@
+package setup
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lox/package-proxy/mitm"
+)
+
+// Config describes the running proxy that clients are being set up for
+type Config struct {
+	// CA is used for tls interception, nil if interception is disabled
+	CA *mitm.CA
+
+	// ProxyURL is how clients reach the proxy, defaults to the Host the
+	// setup request was made to
+	ProxyURL string
+
+	// MitmHosts are the hosts that are intercepted
+	MitmHosts []string
+}
+
+// NewHandler serves the CA certificate and client setup scripts:
+//
+//	GET /ca.crt               the CA certificate in PEM format
+//	GET /ca.der               the CA certificate in DER format
+//	GET /ca.fingerprint       the CA certificate fingerprints
+//	GET /setup/               a list of the available setup scripts
+//	GET /setup/<client>.sh    a setup script for a client, e.g ubuntu or npm
+func NewHandler(config Config) http.Handler {
+	h := &handler{config: config, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/ca.crt", h.caPem)
+	h.mux.HandleFunc("/ca.der", h.caDer)
+	h.mux.HandleFunc("/ca.fingerprint", h.caFingerprint)
+	h.mux.HandleFunc("/setup/", h.script)
+	return h
+}
+
+type handler struct {
+	config Config
+	mux    *http.ServeMux
+}
+
+func (h *handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(rw, req)
+}
+
+func (h *handler) requireCA(rw http.ResponseWriter) bool {
+	if h.config.CA == nil {
+		http.Error(rw, "tls interception isn't enabled", http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+func (h *handler) caPem(rw http.ResponseWriter, req *http.Request) {
+	if h.requireCA(rw) {
+		rw.Header().Set("Content-Type", "application/x-pem-file")
+		rw.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: h.config.CA.Trusted().Raw}))
+	}
+}
+
+func (h *handler) caDer(rw http.ResponseWriter, req *http.Request) {
+	if h.requireCA(rw) {
+		rw.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		rw.Write(h.config.CA.Trusted().Raw)
+	}
+}
+
+func (h *handler) caFingerprint(rw http.ResponseWriter, req *http.Request) {
+	if h.requireCA(rw) {
+		raw := h.config.CA.Trusted().Raw
+		sha256Sum := sha256.Sum256(raw)
+		sha1Sum := sha1.Sum(raw)
+
+		rw.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(rw, "SHA256 Fingerprint=%s\n", fingerprint(sha256Sum[:]))
+		fmt.Fprintf(rw, "SHA1 Fingerprint=%s\n", fingerprint(sha1Sum[:]))
+	}
+}
+
+// fingerprint formats a digest the way openssl x509 -fingerprint does
+func fingerprint(b []byte) string {
+	hex := make([]string, len(b))
+	for i, c := range b {
+		hex[i] = fmt.Sprintf("%02X", c)
+	}
+
+	return strings.Join(hex, ":")
+}
+
+// hostPattern matches a host[:port] that is safe to put in a script
+var hostPattern = regexp.MustCompile(`^([A-Za-z0-9.-]+|\[[0-9A-Fa-f:.]+\])(:[0-9]+)?$`)
+
+type scriptVars struct {
+	ProxyURL  string
+	CAURL     string
+	HasCA     bool
+	MitmHosts []string
+}
+
+// vars returns the values for a script, the proxy url comes from the Host
+// header unless it's configured, so it must be a valid host[:port]
+func (h *handler) vars(req *http.Request) (scriptVars, error) {
+	proxyUrl := h.config.ProxyURL
+	if proxyUrl == "" && !hostPattern.MatchString(req.Host) {
+		return scriptVars{}, fmt.Errorf("invalid host %q, set -public-url", req.Host)
+	} else if proxyUrl == "" && req.TLS != nil {
+		proxyUrl = "https://" + req.Host
+	} else if proxyUrl == "" {
+		proxyUrl = "http://" + req.Host
+	}
+	proxyUrl = strings.TrimRight(proxyUrl, "/")
+
+	hosts := []string{}
+	for _, host := range h.config.MitmHosts {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		hosts = append(hosts, host)
+	}
+
+	return scriptVars{
+		ProxyURL:  proxyUrl,
+		CAURL:     proxyUrl + "/ca.crt",
+		HasCA:     h.config.CA != nil,
+		MitmHosts: hosts,
+	}, nil
+}
+
+func (h *handler) script(rw http.ResponseWriter, req *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/setup/"), ".sh")
+
+	vars, err := h.vars(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if name == "" {
+		names := []string{}
+		for n := range scripts {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		rw.Header().Set("Content-Type", "text/plain")
+		for _, n := range names {
+			fmt.Fprintf(rw, "%s/setup/%s.sh\n", vars.ProxyURL, n)
+		}
+		return
+	}
+
+	t, ok := scripts[name]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, vars); err != nil {
+		log.Printf("error rendering %s setup script: %s", name, err.Error())
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/x-shellscript")
+	buf.WriteTo(rw)
+}
@@ -0,0 +1,114 @@
+package setup
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lox/package-proxy/mitm"
+)
+
+func get(h http.Handler, path, host string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Host = host
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestServesCA(t *testing.T) {
+	ca, err := mitm.NewCA(pkix.Name{CommonName: "Test CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Config{CA: ca})
+
+	if rw := get(h, "/ca.crt", "proxy:3142"); rw.Body.String() != string(ca.CertPEM()) {
+		t.Fatalf("Expected the pem encoded ca, got %q", rw.Body.String())
+	}
+
+	if rw := get(h, "/ca.der", "proxy:3142"); rw.Body.String() != string(ca.Cert.Raw) {
+		t.Fatal("Expected the der encoded ca")
+	}
+
+	if rw := get(h, "/ca.fingerprint", "proxy:3142"); !strings.HasPrefix(rw.Body.String(), "SHA256 Fingerprint=") {
+		t.Fatalf("Unexpected fingerprint %q", rw.Body.String())
+	}
+}
+
+func TestSetupScriptsUseProxyAddress(t *testing.T) {
+	ca, err := mitm.NewCA(pkix.Name{CommonName: "Test CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Config{CA: ca, MitmHosts: []string{"registry.npmjs.org:443"}})
+	body := get(h, "/setup/npm.sh", "proxy:3142").Body.String()
+
+	for _, expected := range []string{
+		`PROXY_URL="http://proxy:3142"`,
+		`curl -fsS -o "$CA_FILE" "http://proxy:3142/ca.crt"`,
+		`export NODE_EXTRA_CA_CERTS=$CA_FILE`,
+		`# tls is intercepted for: registry.npmjs.org`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Expected npm setup script to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestSetupScriptsWithoutCA(t *testing.T) {
+	h := NewHandler(Config{ProxyURL: "http://10.0.0.1:3142"})
+	body := get(h, "/setup/ubuntu.sh", "ignored").Body.String()
+
+	if strings.Contains(body, "update-ca-certificates") {
+		t.Fatal("Expected no ca to be installed without tls interception")
+	}
+
+	if !strings.Contains(body, `Acquire::http::Proxy "http://10.0.0.1:3142/";`) {
+		t.Fatalf("Expected apt proxy config, got:\n%s", body)
+	}
+
+	if rw := get(h, "/ca.crt", "ignored"); rw.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for ca without tls interception, got %d", rw.Code)
+	}
+}
+
+func TestSetupScriptsRejectInvalidHosts(t *testing.T) {
+	h := NewHandler(Config{})
+
+	for _, host := range []string{`proxy";rm -rf /;"`, "proxy:3142/x", "$(id)", ""} {
+		if rw := get(h, "/setup/ubuntu.sh", host); rw.Code != http.StatusBadRequest {
+			t.Fatalf("Expected host %q to be rejected, got %d", host, rw.Code)
+		}
+	}
+
+	if rw := get(h, "/setup/ubuntu.sh", "[::1]:3142"); rw.Code != http.StatusOK {
+		t.Fatalf("Expected an ipv6 host to be accepted, got %d", rw.Code)
+	}
+}
+
+func TestSetupScriptsKeepTheSystemRoots(t *testing.T) {
+	ca, err := mitm.NewCA(pkix.Name{CommonName: "Test CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(Config{CA: ca})
+	for name, expected := range map[string]string{
+		"pip":      `pip config set global.cert "$CA_BUNDLE"`,
+		"composer": `composer config --global cafile "$CA_BUNDLE"`,
+		"gem":      `bundle config set --global ssl_ca_cert "$CA_BUNDLE"`,
+	} {
+		body := get(h, "/setup/"+name+".sh", "proxy:3142").Body.String()
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Expected %s setup script to contain %q, got:\n%s", name, expected, body)
+		} else if !strings.Contains(body, `cat "$SYSTEM_CA_FILE" "$CA_FILE" > "$CA_BUNDLE"`) {
+			t.Fatalf("Expected %s setup script to bundle the system roots, got:\n%s", name, body)
+		}
+	}
+}
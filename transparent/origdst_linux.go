@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package transparent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const soOriginalDst = 80
+
+// OriginalDst returns where a connection redirected by iptables REDIRECT or
+// DNAT was originally headed
+func OriginalDst(conn net.Conn) (string, error) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("original destination needs a tcp connection")
+	}
+
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	level := syscall.SOL_IP
+	if addr, ok := tcp.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level = syscall.SOL_IPV6
+	}
+
+	var addr syscall.RawSockaddrAny
+	var sockErr error
+	size := uint32(unsafe.Sizeof(addr))
+
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&addr)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return "", err
+	} else if sockErr != nil {
+		return "", sockErr
+	}
+
+	// the family is in host byte order, the port in network byte order
+	switch addr.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&addr))
+		return joinPort(net.IP(sa.Addr[:]).String(), networkPort(sa.Port)), nil
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&addr))
+		return joinPort(net.IP(sa.Addr[:]).String(), networkPort(sa.Port)), nil
+	}
+
+	return "", errors.New("unknown address family for original destination")
+}
+
+// networkPort reads a port stored in network byte order
+func networkPort(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(binary.BigEndian.Uint16(b[:]))
+}
+
+func joinPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package transparent
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDst is only supported on linux. Elsewhere only connections for
+// intercepted hosts are served, by their server name, and others are refused
+// rather than tunnelled.
+func OriginalDst(conn net.Conn) (string, error) {
+	return "", errors.New("original destination is only supported on linux")
+}
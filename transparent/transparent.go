@@ -0,0 +1,163 @@
+// Package transparent serves traffic that was redirected to the proxy, for
+// example with iptables, from clients that don't know they're being proxied.
+package transparent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const peekTimeout = time.Second * 10
+
+var errPeeked = errors.New("peeked client hello")
+
+// Interceptor decides whether tls for a host is intercepted or tunnelled
+type Interceptor interface {
+	Match(hostport string) bool
+	InterceptConn(conn net.Conn, hostport string)
+	TunnelConn(conn net.Conn, hostport, addr string)
+}
+
+// Handler routes plain http requests by their Host header
+func Handler(proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Host == "" {
+			http.Error(rw, "a Host header is required", http.StatusBadRequest)
+			return
+		}
+
+		if !req.URL.IsAbs() {
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+		}
+
+		proxy.ServeHTTP(rw, req)
+	})
+}
+
+// ServeTLS accepts redirected tls connections on l, routing each by the
+// server name in its ClientHello
+func ServeTLS(l net.Listener, i Interceptor) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Millisecond * 100)
+				continue
+			}
+			return err
+		}
+
+		go serveConn(conn, i)
+	}
+}
+
+func serveConn(conn net.Conn, i Interceptor) {
+	dst, dstErr := OriginalDst(conn)
+	if dstErr == nil && sameAddr(dst, conn.LocalAddr()) {
+		// the client connected to the listener itself, not a redirected host
+		dstErr = errors.New("original destination is the listener")
+	}
+
+	serverName, peeked, err := peekServerName(conn)
+	if err != nil {
+		log.Printf("error reading client hello from %s: %s", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+
+	port := "443"
+	if dstErr == nil {
+		_, port, _ = net.SplitHostPort(dst)
+	}
+
+	hostport := dst
+	if serverName != "" {
+		hostport = net.JoinHostPort(serverName, port)
+	}
+
+	if serverName != "" && i.Match(hostport) {
+		i.InterceptConn(peeked, hostport)
+		return
+	}
+
+	// the server name comes from the client, so only tunnel to where the
+	// connection was originally going
+	if dstErr != nil {
+		log.Printf("not tunnelling %s for %s without an original destination: %s", hostport, conn.RemoteAddr(), dstErr.Error())
+		conn.Close()
+		return
+	}
+
+	i.TunnelConn(peeked, hostport, dst)
+}
+
+// sameAddr returns whether a host:port is the same as addr
+func sameAddr(hostport string, addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return hostport == addr.String()
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(tcp.IP) && port == strconv.Itoa(tcp.Port)
+}
+
+// peekServerName reads the ClientHello from conn, returning the server name
+// and a conn that replays what was read
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	buf := &bytes.Buffer{}
+	var serverName string
+	var peeked bool
+
+	conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	err := tls.Server(&readOnlyConn{Conn: conn, r: io.TeeReader(conn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, peeked = hello.ServerName, true
+			return nil, errPeeked
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+
+	if !peeked {
+		return "", nil, err
+	}
+
+	return serverName, &prefixConn{Conn: conn, r: io.MultiReader(buf, conn)}, nil
+}
+
+// readOnlyConn stops the tls server peeking at a ClientHello from replying
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// prefixConn replays peeked bytes before reading from the connection
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
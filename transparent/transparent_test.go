@@ -0,0 +1,119 @@
+package transparent
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandlerRoutesByHostHeader(t *testing.T) {
+	var got string
+	h := Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.URL.String()
+	}))
+
+	req, _ := http.NewRequest("GET", "/ubuntu/dists/trusty/Release", nil)
+	req.URL.Scheme, req.URL.Host = "", ""
+	req.Host = "archive.ubuntu.com"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got != "http://archive.ubuntu.com/ubuntu/dists/trusty/Release" {
+		t.Fatalf("Unexpected url %q", got)
+	}
+}
+
+type testInterceptor struct {
+	intercepted chan string
+	hello       chan []byte
+}
+
+func (i *testInterceptor) Match(hostport string) bool {
+	return hostport == "registry.npmjs.org:443"
+}
+
+func (i *testInterceptor) InterceptConn(conn net.Conn, hostport string) {
+	i.intercepted <- hostport
+	b := make([]byte, 1)
+	io.ReadFull(conn, b)
+	i.hello <- b
+	conn.Close()
+}
+
+func (i *testInterceptor) TunnelConn(conn net.Conn, hostport, addr string) {
+	i.intercepted <- "tunnel " + hostport
+	conn.Close()
+}
+
+func TestServeTLSRoutesByServerName(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	i := &testInterceptor{intercepted: make(chan string, 1), hello: make(chan []byte, 1)}
+	go ServeTLS(l, i)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := tls.Client(conn, &tls.Config{ServerName: "registry.npmjs.org"})
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	go client.Handshake()
+
+	if got := <-i.intercepted; got != "registry.npmjs.org:443" {
+		t.Fatalf("Expected registry.npmjs.org:443, got %q", got)
+	}
+	conn.Close()
+
+	// the intercepted conn replays the peeked ClientHello
+	if b := <-i.hello; b[0] != 0x16 {
+		t.Fatalf("Expected a tls handshake record, got %x", b)
+	}
+}
+
+func TestServeTLSRefusesToTunnelWithoutOriginalDst(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	i := &testInterceptor{intercepted: make(chan string, 1), hello: make(chan []byte, 1)}
+	go ServeTLS(l, i)
+
+	// connecting to the listener directly has no redirected destination
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := tls.Client(conn, &tls.Config{ServerName: "github.com"})
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	if err := client.Handshake(); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+
+	select {
+	case got := <-i.intercepted:
+		t.Fatalf("Expected no tunnel, got %q", got)
+	default:
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3443}
+
+	if !sameAddr("127.0.0.1:3443", addr) {
+		t.Fatal("Expected the listener's address to match")
+	} else if sameAddr("127.0.0.1:443", addr) || sameAddr("10.0.0.1:3443", addr) {
+		t.Fatal("Expected other addresses not to match")
+	}
+}
@@ -0,0 +1,33 @@
+package ubuntu
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// check fetches the HealthPath from each mirror, or if the archive's release
+// date is known checks each mirror is current
+func (ur *ubuntuRewriter) check(mirrors []string) []error {
+	errs := make([]error, len(mirrors))
+	archive := archiveDate(ur.config)
+
+	for i, m := range mirrors {
+		if !archive.IsZero() {
+			errs[i] = checkCurrent(ur.config, m, archive)
+			continue
+		}
+
+		resp, err := ur.config.Client.Get(m + ur.config.HealthPath)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			errs[i] = fmt.Errorf("returned %s", resp.Status)
+		}
+	}
+
+	return errs
+}
@@ -2,111 +2,406 @@ package ubuntu
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
 const (
 	mirrorsUrl       = "http://mirrors.ubuntu.com/mirrors.txt"
-	benchmarkUrl     = "dists/saucy/main/binary-amd64/Packages.bz2"
+	archiveUrl       = "http://archive.ubuntu.com/ubuntu/"
+	defaultSuite     = "noble"
+	maxLag           = time.Hour * 6
 	benchmarkTimes   = 3
 	benchmarkBytes   = 1024 * 512 // 512Kb
-	benchmarkTimeout = 20         // 20 seconds
+	benchmarkTimeout = time.Second * 20
+	sampleSize       = 3
+	stateMaxAge      = time.Hour * 24 * 7
+	healthInterval   = time.Minute
+	downFor          = time.Minute * 5
+	rebenchmark      = time.Hour * 24
+	explore          = 0.05
 )
 
-type Mirrors struct {
-	URLs []string
+// Config controls how ubuntu mirrors are discovered and benchmarked, zero
+// values use the defaults
+type Config struct {
+	// Client is used for fetching the mirror list and benchmarking
+	Client *http.Client
+
+	// Source lists candidate mirrors, defaults to mirrors.ubuntu.com
+	Source Source
+
+	// Suite is the release mirrors must carry, defaults to the host's ubuntu
+	// release or noble
+	Suite string
+
+	// Archive is the canonical archive, a mirror whose InRelease for Suite
+	// is dated more than MaxLag before the archive's isn't used. A negative
+	// MaxLag disables the check.
+	Archive string
+	MaxLag  time.Duration
+
+	// BenchmarkPath is fetched from each mirror BenchmarkTimes times, reading
+	// up to BenchmarkBytes each time
+	BenchmarkPath  string
+	BenchmarkTimes int
+	BenchmarkBytes int64
+
+	// Timeout is how long to wait for benchmark results
+	Timeout time.Duration
+
+	// SampleSize is how many mirrors to wait for before ranking them, the
+	// ones after the fastest are used as alternates
+	SampleSize int
+
+	// StateFile persists the ranked mirrors for StateMaxAge, so restarts
+	// don't benchmark again
+	StateFile   string
+	StateMaxAge time.Duration
+
+	// HealthPath is fetched from each mirror every HealthInterval, a mirror
+	// that fails a check or a request isn't used for DownFor
+	HealthPath     string
+	HealthInterval time.Duration
+	DownFor        time.Duration
+
+	// Rebenchmark is how often mirrors are discovered and ranked again
+	Rebenchmark time.Duration
+
+	// Explore is the share of requests sent to mirrors other than the best,
+	// so their throughput and error rates are measured. A negative Explore
+	// sends every request to the best mirror.
+	Explore float64
 }
 
-func GetGeoMirrors() (m Mirrors, err error) {
-	response, err := http.Get(mirrorsUrl)
-	if err != nil {
-		return
+func (c Config) withDefaults() Config {
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: benchmarkTimeout}
+	}
+	if c.Source == nil {
+		c.Source = URLSource(mirrorsUrl)
+	}
+	if c.Suite == "" {
+		c.Suite = hostSuite()
 	}
+	if c.Archive == "" {
+		c.Archive = archiveUrl
+	}
+	if c.MaxLag == 0 {
+		c.MaxLag = maxLag
+	}
+	if c.BenchmarkPath == "" {
+		c.BenchmarkPath = "dists/" + c.Suite + "/main/binary-amd64/Packages.gz"
+	}
+	if c.BenchmarkTimes == 0 {
+		c.BenchmarkTimes = benchmarkTimes
+	}
+	if c.BenchmarkBytes == 0 {
+		c.BenchmarkBytes = benchmarkBytes
+	}
+	if c.Timeout == 0 {
+		c.Timeout = benchmarkTimeout
+	}
+	if c.SampleSize == 0 {
+		c.SampleSize = sampleSize
+	}
+	if c.StateMaxAge == 0 {
+		c.StateMaxAge = stateMaxAge
+	}
+	if c.HealthPath == "" {
+		c.HealthPath = "dists/" + c.Suite + "/InRelease"
+	}
+	if c.HealthInterval == 0 {
+		c.HealthInterval = healthInterval
+	}
+	if c.DownFor == 0 {
+		c.DownFor = downFor
+	}
+	if c.Rebenchmark == 0 {
+		c.Rebenchmark = rebenchmark
+	}
+	if c.Explore == 0 {
+		c.Explore = explore
+	}
+	return c
+}
 
+// Source provides a list of candidate mirror urls
+type Source interface {
+	Mirrors(client *http.Client) (Mirrors, error)
+}
+
+// URLSource fetches a mirrors.txt style list, one url per line
+type URLSource string
+
+func (s URLSource) Mirrors(client *http.Client) (Mirrors, error) {
+	response, err := client.Get(string(s))
+	if err != nil {
+		return Mirrors{}, err
+	}
 	defer response.Body.Close()
-	scanner := bufio.NewScanner(response.Body)
-	m.URLs = []string{}
+
+	if response.StatusCode != http.StatusOK {
+		return Mirrors{}, fmt.Errorf("fetching %s returned %s", s, response.Status)
+	}
+
+	return parseMirrors(response.Body)
+}
+
+// FileSource reads a mirrors.txt style list from a file
+type FileSource string
+
+func (s FileSource) Mirrors(client *http.Client) (Mirrors, error) {
+	f, err := os.Open(string(s))
+	if err != nil {
+		return Mirrors{}, err
+	}
+	defer f.Close()
+
+	return parseMirrors(f)
+}
+
+// StaticSource is a fixed list of mirrors
+type StaticSource []string
+
+func (s StaticSource) Mirrors(client *http.Client) (Mirrors, error) {
+	return Mirrors{URLs: normalizeUrls(s)}, nil
+}
+
+func parseMirrors(r io.Reader) (Mirrors, error) {
+	scanner := bufio.NewScanner(r)
+	urls := []string{}
 
 	// read urls line by line
 	for scanner.Scan() {
-		m.URLs = append(m.URLs, scanner.Text())
+		urls = append(urls, scanner.Text())
+	}
+
+	return Mirrors{URLs: normalizeUrls(urls)}, scanner.Err()
+}
+
+// normalizeUrls drops blank lines and comments and adds a trailing slash
+func normalizeUrls(urls []string) []string {
+	normalized := []string{}
+
+	for _, u := range urls {
+		u = strings.TrimSpace(u)
+		if u == "" || strings.HasPrefix(u, "#") {
+			continue
+		}
+		if !strings.HasSuffix(u, "/") {
+			u += "/"
+		}
+		normalized = append(normalized, u)
+	}
+
+	return normalized
+}
+
+type Mirrors struct {
+	URLs []string
+}
+
+// GetGeoMirrors returns the mirrors mirrors.ubuntu.com lists for our location
+func GetGeoMirrors() (Mirrors, error) {
+	return URLSource(mirrorsUrl).Mirrors(http.DefaultClient)
+}
+
+// Discover returns the persisted mirrors if they're recent enough, otherwise
+// it benchmarks the mirrors from the source and persists them, fastest first
+func Discover(config Config) ([]string, error) {
+	config = config.withDefaults()
+
+	if mirrors, ok := loadState(config); ok {
+		log.Printf("using ubuntu mirrors from %s", config.StateFile)
+		return mirrors, nil
 	}
 
-	return m, scanner.Err()
+	return discover(config)
 }
 
-func (m Mirrors) Fastest() (string, error) {
-	ch := make(chan benchmarkResult)
+func discover(config Config) ([]string, error) {
+	mirrors, err := config.Source.Mirrors(config.Client)
+	if err != nil {
+		return nil, err
+	} else if len(mirrors.URLs) == 0 {
+		return nil, errors.New("no ubuntu mirrors found")
+	}
+
+	ranked, err := mirrors.Rank(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveState(config, ranked); err != nil {
+		log.Printf("error saving ubuntu mirrors: %s", err.Error())
+	}
+
+	return ranked, nil
+}
+
+// Fastest returns the fastest of the mirrors
+func (m Mirrors) Fastest(config Config) (string, error) {
+	ranked, err := m.Rank(config)
+	if err != nil {
+		return "", err
+	}
+
+	return ranked[0], nil
+}
+
+// Rank benchmarks the mirrors and returns the first SampleSize to respond,
+// fastest first. Mirrors that lag the archive are dropped.
+func (m Mirrors) Rank(config Config) ([]string, error) {
+	config = config.withDefaults()
+	ch := make(chan benchmarkResult, len(m.URLs))
+	archive := archiveDate(config)
 
 	// kick off all benchmarks in parallel
 	for _, url := range m.URLs {
 		go func(u string) {
-			duration, err := m.benchmark(u, benchmarkTimes)
-			if err == nil {
-				ch <- benchmarkResult{u, duration}
+			if err := checkCurrent(config, u, archive); err != nil {
+				ch <- benchmarkResult{u, 0, err}
+				return
 			}
+			duration, err := m.benchmark(config, u)
+			ch <- benchmarkResult{u, duration, err}
 		}(url)
 	}
 
 	readN := len(m.URLs)
-	if 3 < readN {
-		readN = 3
+	if config.SampleSize < readN {
+		readN = config.SampleSize
 	}
 
 	// wait for the fastest results to come back
-	results, err := m.readResults(ch, readN)
-	if len(results) == 0 {
-		return "", errors.New("No results found: " + err.Error())
+	results, err := m.readResults(ch, readN, len(m.URLs), config.Timeout)
+	if len(results) == 0 && err == nil {
+		return nil, errors.New("No results found")
+	} else if len(results) == 0 {
+		return nil, errors.New("No results found: " + err.Error())
 	} else if err != nil {
 		log.Printf("Error benchmarking mirrors: %s", err.Error())
 	}
 
-	return results[0].URL, nil
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Duration < results[j].Duration
+	})
+
+	ranked := make([]string, len(results))
+	for i, r := range results {
+		ranked[i] = r.URL
+	}
+
+	return ranked, nil
 }
 
-func (m Mirrors) readResults(ch <-chan benchmarkResult, size int) (br []benchmarkResult, err error) {
-	for {
+// readResults waits for size successful results, or until all benchmarks
+// have finished or timed out
+func (m Mirrors) readResults(ch <-chan benchmarkResult, size, total int, timeout time.Duration) (br []benchmarkResult, err error) {
+	deadline := time.After(timeout)
+
+	for finished := 0; finished < total; finished++ {
 		select {
 		case r := <-ch:
+			if r.Err != nil {
+				err = r.Err
+				continue
+			}
 			br = append(br, r)
 			if len(br) == size {
-				return
+				return br, nil
 			}
-		case <-time.After(benchmarkTimeout * time.Second):
+		case <-deadline:
 			return br, errors.New("Timed out waiting for results")
 		}
 	}
+
+	return br, err
 }
 
-func (m Mirrors) benchmark(url string, times int) (time.Duration, error) {
+func (m Mirrors) benchmark(config Config, url string) (time.Duration, error) {
 	var sum int64
 	var d time.Duration
-	url = url + benchmarkUrl
+	url = url + config.BenchmarkPath
 
-	for i := 0; i < times; i++ {
+	for i := 0; i < config.BenchmarkTimes; i++ {
 		timer := time.Now()
-		response, err := http.Get(url)
+		response, err := config.Client.Get(url)
 		if err != nil {
 			return d, err
 		}
 
-		_, err = io.ReadAtLeast(response.Body, make([]byte, benchmarkBytes), benchmarkBytes)
-		if err != nil {
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return d, fmt.Errorf("%s returned %s", url, response.Status)
+		}
+
+		_, err = io.CopyN(ioutil.Discard, response.Body, config.BenchmarkBytes)
+		response.Body.Close()
+		if err != nil && err != io.EOF {
 			return d, err
 		}
 
 		sum = sum + int64(time.Since(timer))
-		response.Body.Close()
 	}
 
-	return time.Duration(sum / int64(times)), nil
+	return time.Duration(sum / int64(config.BenchmarkTimes)), nil
 }
 
 type benchmarkResult struct {
 	URL      string
 	Duration time.Duration
+	Err      error
+}
+
+type state struct {
+	Mirrors    []string  `json:"mirrors"`
+	Mirror     string    `json:"mirror,omitempty"`
+	SelectedAt time.Time `json:"selected_at"`
+}
+
+func loadState(config Config) ([]string, bool) {
+	if config.StateFile == "" {
+		return nil, false
+	}
+
+	b, err := ioutil.ReadFile(config.StateFile)
+	if err != nil {
+		return nil, false
+	}
+
+	var s state
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, false
+	}
+
+	// state files used to hold a single mirror
+	if len(s.Mirrors) == 0 && s.Mirror != "" {
+		s.Mirrors = []string{s.Mirror}
+	}
+
+	return s.Mirrors, len(s.Mirrors) > 0 && time.Since(s.SelectedAt) < config.StateMaxAge
+}
+
+func saveState(config Config, mirrors []string) error {
+	if config.StateFile == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(state{Mirrors: mirrors, SelectedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(config.StateFile, b, 0644)
 }
@@ -1,31 +1,290 @@
 package ubuntu
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+var released = time.Date(2024, 4, 25, 15, 10, 33, 0, time.UTC)
+
+// newMirror serves a current InRelease and the benchmark file after a delay
+func newMirror(delay time.Duration) *httptest.Server {
+	return newMirrorAt(delay, released)
+}
+
+// newMirrorAt serves an InRelease dated date and the benchmark file after a
+// delay
+func newMirrorAt(delay time.Duration, date time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "dists/noble/InRelease"):
+			fmt.Fprintf(rw, "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA512\n\nOrigin: Ubuntu\nSuite: noble\nDate: %s\n", date.Format(time.RFC1123))
+		case strings.HasSuffix(req.URL.Path, "dists/noble/main/binary-amd64/Packages.gz"):
+			time.Sleep(delay)
+			rw.Write(make([]byte, 1024))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+}
+
+func newMirrorList(urls ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, strings.Join(urls, "\n"))
+	}))
+}
+
 func TestMirrors(t *testing.T) {
-	mirrors, err := GetGeoMirrors()
+	list := newMirrorList("http://a.example.org/ubuntu/", "", "http://b.example.org/ubuntu")
+	defer list.Close()
+
+	mirrors, err := URLSource(list.URL).Mirrors(http.DefaultClient)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(mirrors.URLs) == 0 {
-		t.Fatal("No mirrors found")
+	expected := []string{"http://a.example.org/ubuntu/", "http://b.example.org/ubuntu/"}
+	if fmt.Sprint(mirrors.URLs) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v, got %v", expected, mirrors.URLs)
 	}
 }
 
 func TestMirrorsBenchmark(t *testing.T) {
-	mirrors, err := GetGeoMirrors()
+	slow, fast, broken := newMirror(time.Millisecond*50), newMirror(0), httptest.NewServer(http.NotFoundHandler())
+	defer slow.Close()
+	defer fast.Close()
+	defer broken.Close()
+
+	mirrors := Mirrors{URLs: []string{slow.URL + "/", fast.URL + "/", broken.URL + "/"}}
+	fastest, err := mirrors.Fastest(Config{Suite: "noble", Archive: fast.URL + "/", Timeout: time.Second * 5})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	fastest, err := mirrors.Fastest()
+	if fastest != fast.URL+"/" {
+		t.Fatalf("Expected %s to be fastest, got %s", fast.URL, fastest)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mirrors.txt")
+	ioutil.WriteFile(file, []byte("# local mirrors\nhttp://mirror.local/ubuntu\n"), 0644)
+
+	mirrors, err := FileSource(file).Mirrors(nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	log.Printf("Fastest mirror is %s", fastest)
+	if len(mirrors.URLs) != 1 || mirrors.URLs[0] != "http://mirror.local/ubuntu/" {
+		t.Fatalf("Unexpected mirrors %v", mirrors.URLs)
+	}
+}
+
+func TestStaleMirrorsAreDropped(t *testing.T) {
+	archive := newMirror(0)
+	stale, current := newMirrorAt(0, released.Add(-time.Hour*12)), newMirrorAt(time.Millisecond*50, released.Add(-time.Hour))
+	defer archive.Close()
+	defer stale.Close()
+	defer current.Close()
+
+	mirrors := Mirrors{URLs: []string{stale.URL + "/", current.URL + "/"}}
+	ranked, err := mirrors.Rank(Config{Suite: "noble", Archive: archive.URL + "/", Timeout: time.Second * 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ranked) != 1 || ranked[0] != current.URL+"/" {
+		t.Fatalf("Expected only the current mirror, got %v", ranked)
+	}
+}
+
+func TestParseReleaseDate(t *testing.T) {
+	date, err := parseReleaseDate(strings.NewReader("Origin: Ubuntu\nDate: Thu, 25 Apr 2024 15:10:33 UTC\nValid-Until: Thu, 02 May 2024 15:10:33 UTC\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !date.Equal(released) {
+		t.Fatalf("Expected %s, got %s", released, date)
+	}
+}
+
+func TestDiscoverPersistsTheSelectedMirror(t *testing.T) {
+	mirror := newMirror(0)
+	stateFile := filepath.Join(t.TempDir(), "ubuntu-mirror.json")
+	config := Config{Source: StaticSource{mirror.URL}, Suite: "noble", MaxLag: -1, StateFile: stateFile}
+
+	selected, err := Discover(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with the mirror gone, a restart should still use it without benchmarking
+	mirror.Close()
+	config.Source = StaticSource{}
+
+	again, err := Discover(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(again) != fmt.Sprint(selected) {
+		t.Fatalf("Expected persisted mirrors %v, got %v", selected, again)
+	}
+}
+
+func TestDiscoveryFailuresDontRewrite(t *testing.T) {
+	list := httptest.NewServer(http.NotFoundHandler())
+	defer list.Close()
+
+	u := NewRewriter(Config{Source: URLSource(list.URL)})
+	time.Sleep(time.Millisecond * 100)
+
+	req, _ := http.NewRequest("GET", "http://archive.ubuntu.com/ubuntu/dists/noble/Release", nil)
+	u.Rewrite(req)
+
+	if req.URL.Host != "archive.ubuntu.com" {
+		t.Fatalf("Expected no rewriting, got %s", req.URL)
+	}
+}
+
+func TestRewriterUsesMirror(t *testing.T) {
+	u := newRewriter(Config{})
+	u.SetMirror("http://mirror.local/ubuntu/")
+
+	req, _ := http.NewRequest("GET", "http://archive.ubuntu.com/ubuntu/dists/noble/Release", nil)
+	u.Rewrite(req)
+
+	if req.URL.String() != "http://mirror.local/ubuntu/dists/noble/Release" {
+		t.Fatalf("Unexpected rewrite %s", req.URL)
+	}
+}
+
+func TestFailoverToNextMirrorThenArchive(t *testing.T) {
+	u := newRewriter(Config{MaxLag: -1})
+	u.SetMirrors("http://a.example.org/ubuntu/", "https://b.example.org/ubuntu/")
+
+	original, _ := url.Parse("http://archive.ubuntu.com/ubuntu/dists/noble/Release")
+	req, _ := http.NewRequest("GET", original.String(), nil)
+	u.Rewrite(req)
+
+	next := u.Failover(req, original, nil, errors.New("timeout"))
+	if next == nil || next.String() != "https://b.example.org/ubuntu/dists/noble/Release" {
+		t.Fatalf("Expected failover to the second mirror, got %v", next)
+	}
+
+	// the failed mirror isn't used for new requests
+	req, _ = http.NewRequest("GET", original.String(), nil)
+	u.Rewrite(req)
+	if req.URL.Host != "b.example.org" {
+		t.Fatalf("Expected the second mirror to be used, got %s", req.URL)
+	}
+
+	req.URL = next
+	if last := u.Failover(req, original, nil, errors.New("timeout")); last == nil || last.String() != original.String() {
+		t.Fatalf("Expected failover to the archive, got %v", last)
+	}
+
+	req.URL = original
+	if u.Failover(req, original, nil, errors.New("timeout")) != nil {
+		t.Fatal("Expected no failover from the archive")
+	}
+}
+
+func TestHealthChecksRestoreMirrors(t *testing.T) {
+	healthy := true
+	mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !healthy {
+			http.Error(rw, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer mirror.Close()
+
+	u := newRewriter(Config{Suite: "noble", MaxLag: -1})
+	u.SetMirrors(mirror.URL + "/ubuntu/")
+
+	healthy = false
+	u.CheckHealth()
+	if u.Mirror() != nil {
+		t.Fatal("Expected a failed health check to mark the mirror down")
+	}
+
+	healthy = true
+	u.CheckHealth()
+	if u.Mirror() == nil {
+		t.Fatal("Expected a passing health check to restore the mirror")
+	}
+}
+
+func TestHealthChecksDropStaleMirrors(t *testing.T) {
+	archive, stale := newMirror(0), newMirrorAt(0, released.Add(-time.Hour*12))
+	defer archive.Close()
+	defer stale.Close()
+
+	u := newRewriter(Config{Suite: "noble", Archive: archive.URL + "/"})
+	u.SetMirrors(stale.URL + "/")
+
+	u.CheckHealth()
+	if u.Mirror() != nil {
+		t.Fatal("Expected a stale mirror to be marked down")
+	}
+}
+
+func TestTrafficPicksTheBestMirror(t *testing.T) {
+	u := newRewriter(Config{Explore: -1})
+	u.SetMirrors("http://a.example.org/ubuntu/", "http://b.example.org/ubuntu/")
+
+	observe := func(host string, bytes int64, duration time.Duration, err error) {
+		req, _ := http.NewRequest("GET", "http://"+host+"/ubuntu/pool/main/b/bash.deb", nil)
+		u.Observe(req, bytes, duration, err)
+	}
+
+	// the benchmark winner is used until there's traffic
+	if m := u.Mirror(); m.Host != "a.example.org" {
+		t.Fatalf("Expected the first mirror, got %s", m)
+	}
+
+	observe("a.example.org", 1024*1024, time.Second, nil)
+	observe("b.example.org", 1024*1024, time.Second/4, nil)
+
+	if m := u.Mirror(); m.Host != "b.example.org" {
+		t.Fatalf("Expected the faster mirror, got %s", m)
+	}
+
+	for i := 0; i < 10; i++ {
+		observe("b.example.org", 0, time.Second, errors.New("timeout"))
+	}
+
+	if m := u.Mirror(); m.Host != "a.example.org" {
+		t.Fatalf("Expected failing mirror to be avoided, got %s", m)
+	}
+
+	stats := u.MirrorStats()
+	if len(stats) != 2 || !stats[0].Selected || stats[1].Errors != 10 {
+		t.Fatalf("Unexpected stats %#v", stats)
+	}
+}
+
+func TestExploreSendsSomeRequestsElsewhere(t *testing.T) {
+	u := newRewriter(Config{Explore: 0.5})
+	u.SetMirrors("http://a.example.org/ubuntu/", "http://b.example.org/ubuntu/")
+
+	hosts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest("GET", "http://archive.ubuntu.com/ubuntu/dists/noble/InRelease", nil)
+		u.Rewrite(req)
+		hosts[req.URL.Host]++
+	}
+
+	if hosts["a.example.org"] == 0 || hosts["b.example.org"] == 0 {
+		t.Fatalf("Expected requests to both mirrors, got %v", hosts)
+	}
 }
@@ -0,0 +1,124 @@
+package ubuntu
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// hostSuite returns the codename of the ubuntu release we're running on,
+// falling back to defaultSuite elsewhere
+func hostSuite() string {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return defaultSuite
+	}
+	defer f.Close()
+
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if kv := strings.SplitN(scanner.Text(), "=", 2); len(kv) == 2 {
+			fields[kv[0]] = strings.Trim(kv[1], `"'`)
+		}
+	}
+
+	if suite := fields["UBUNTU_CODENAME"]; suite != "" {
+		return suite
+	} else if fields["ID"] == "ubuntu" && fields["VERSION_CODENAME"] != "" {
+		return fields["VERSION_CODENAME"]
+	}
+
+	return defaultSuite
+}
+
+// releaseDate fetches the InRelease file for a suite from a mirror and
+// returns its Date field
+func releaseDate(client *http.Client, mirror, suite string) (time.Time, error) {
+	u := mirror + "dists/" + suite + "/InRelease"
+
+	resp, err := client.Get(u)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+
+	date, err := parseReleaseDate(resp.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %s", u, err.Error())
+	}
+
+	return date, nil
+}
+
+// parseReleaseDate reads the Date field from a Release or InRelease file
+func parseReleaseDate(r io.Reader) (time.Time, error) {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Date:") {
+			continue
+		}
+
+		value := strings.TrimSpace(strings.TrimPrefix(line, "Date:"))
+		for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, nil
+			}
+		}
+
+		return time.Time{}, fmt.Errorf("unrecognised date %q", value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Time{}, errors.New("no Date field")
+}
+
+// archiveDate returns the Date of the canonical archive's InRelease, a zero
+// time means mirrors aren't checked for staleness
+func archiveDate(config Config) time.Time {
+	if config.MaxLag < 0 {
+		return time.Time{}
+	}
+
+	date, err := releaseDate(config.Client, config.Archive, config.Suite)
+	if err != nil {
+		log.Printf("error fetching the ubuntu archive release, not checking mirrors are current: %s", err.Error())
+		return time.Time{}
+	}
+
+	return date
+}
+
+// checkCurrent returns an error if a mirror's InRelease lags the archive by
+// more than the config's MaxLag
+func checkCurrent(config Config, mirror string, archive time.Time) error {
+	if archive.IsZero() {
+		return nil
+	}
+
+	date, err := releaseDate(config.Client, mirror, config.Suite)
+	if err != nil {
+		return err
+	}
+
+	if lag := archive.Sub(date); lag > config.MaxLag {
+		return fmt.Errorf("%s is %s behind the archive", mirror, lag)
+	}
+
+	return nil
+}
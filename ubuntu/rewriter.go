@@ -2,48 +2,73 @@ package ubuntu
 
 import (
 	"log"
-	"net/http"
-	"net/url"
-	"regexp"
+
+	"github.com/lox/package-proxy/mirror"
 )
 
-type ubuntuRewriter struct {
-	mirror *url.URL
+// origins are the hosts requests are rewritten from
+var origins = []mirror.Origin{
+	{Host: "archive.ubuntu.com", Path: "/ubuntu/"},
+	{Host: "security.ubuntu.com", Path: "/ubuntu/"},
 }
 
-var hostPattern = regexp.MustCompile(
-	`https?://(security|archive).ubuntu.com/ubuntu/(.+)$`,
-)
+// ubuntuRewriter is a mirror group for the ubuntu archive, with mirrors that
+// are discovered and benchmarked and health checks that drop stale mirrors
+type ubuntuRewriter struct {
+	*mirror.Group
+	config Config
+}
 
-func NewRewriter() *ubuntuRewriter {
-	u := &ubuntuRewriter{}
+// NewRewriter rewrites requests for the ubuntu archive to the healthy mirror
+// with the best throughput, sending a share of requests to the others so
+// their stats stay current. Until a mirror is found, if discovery fails or if
+// every mirror is down, requests go to the original host.
+func NewRewriter(config Config) *ubuntuRewriter {
+	u := newRewriter(config)
 
 	// benchmark in the background to make sure we have the fastest
 	go func() {
-		mirrors, err := GetGeoMirrors()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		mirror, err := mirrors.Fastest()
+		mirrors, err := Discover(u.config)
 		if err != nil {
-			log.Println(err)
+			log.Printf("error finding an ubuntu mirror, not rewriting: %s", err.Error())
+		} else if err := u.SetMirrors(mirrors...); err != nil {
+			log.Printf("error using ubuntu mirrors: %s", err.Error())
 		}
 
-		if mirrorUrl, err := url.Parse(mirror); err == nil {
-			log.Printf("using ubuntu mirror %s", mirror)
-			u.mirror = mirrorUrl
-		}
+		u.Start()
 	}()
 
 	return u
 }
 
-func (ur *ubuntuRewriter) Rewrite(r *http.Request) {
-	url := r.URL.String()
-	if ur.mirror != nil && hostPattern.MatchString(url) {
-		m := hostPattern.FindAllStringSubmatch(url, -1)
-		r.URL.Host = ur.mirror.Host
-		r.URL.Path = ur.mirror.Path + m[0][2]
+func newRewriter(config Config) *ubuntuRewriter {
+	u := &ubuntuRewriter{config: config.withDefaults()}
+
+	group, err := mirror.NewGroup(mirror.Config{
+		Name:           "ubuntu",
+		Origins:        origins,
+		Strategy:       mirror.Fastest,
+		Explore:        u.config.Explore,
+		Client:         u.config.Client,
+		HealthPath:     u.config.HealthPath,
+		HealthInterval: u.config.HealthInterval,
+		DownFor:        u.config.DownFor,
+		Check:          u.check,
+		Refresh: func() ([]string, error) {
+			return discover(u.config)
+		},
+		RefreshInterval: u.config.Rebenchmark,
+	})
+	if err != nil {
+		// the group's config is fixed, so this can't happen
+		panic(err)
 	}
+
+	u.Group = group
+	return u
+}
+
+// SetMirror uses a single mirror
+func (ur *ubuntuRewriter) SetMirror(m string) error {
+	return ur.SetMirrors(m)
 }
@@ -0,0 +1,209 @@
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HostConfig is how tls connections to an upstream host are made
+type HostConfig struct {
+	// CAFiles are PEM bundles trusted in addition to the system roots
+	CAFiles []string `json:"ca"`
+
+	// Pins are base64 sha256 hashes of a trusted public key, prefixed with
+	// "sha256/". One certificate in a verified chain must match if any are
+	// set, or the leaf if the chain isn't verified.
+	Pins []string `json:"pins"`
+
+	// CertFile and KeyFile are a client certificate for mutual tls
+	CertFile string `json:"cert"`
+	KeyFile  string `json:"key"`
+
+	// Insecure skips verifying the certificate chain, pins are still checked
+	Insecure bool `json:"insecure"`
+}
+
+// TLS holds the tls config for upstream hosts, "*" applies to hosts without
+// their own config
+type TLS struct {
+	hosts map[string]*tls.Config
+}
+
+// LoadTLS reads a json file mapping hosts to a HostConfig
+func LoadTLS(file string) (*TLS, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := map[string]HostConfig{}
+	if err := json.Unmarshal(b, &hosts); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+
+	return NewTLS(hosts)
+}
+
+// NewTLS builds tls configs for each host
+func NewTLS(hosts map[string]HostConfig) (*TLS, error) {
+	t := &TLS{hosts: map[string]*tls.Config{}}
+
+	for host, hc := range hosts {
+		config, err := hc.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls for %s: %s", host, err.Error())
+		}
+		if hc.Insecure {
+			log.Printf("warning: not verifying tls certificates for %s", host)
+		}
+		t.hosts[strings.ToLower(host)] = config
+	}
+
+	return t, nil
+}
+
+// Config returns the tls config for connecting to host, which can have a port
+func (t *TLS) Config(host string) *tls.Config {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	var config *tls.Config
+	if t != nil {
+		if c, ok := t.hosts[host]; ok {
+			config = c
+		} else if c, ok := t.hosts["*"]; ok {
+			config = c
+		}
+	}
+
+	if config == nil {
+		return &tls.Config{ServerName: host}
+	}
+
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// Transport returns an http transport that uses the per-host tls configs
+func (t *TLS) Transport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	return &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialContext:       dialer.DialContext,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			config := t.Config(addr)
+			config.NextProtos = []string{"h2", "http/1.1"}
+
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			return tlsConn, nil
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+func (hc HostConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(hc.CAFiles) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+
+		for _, file := range hc.CAFiles {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !roots.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("no certificates found in %s", file)
+			}
+		}
+
+		config.RootCAs = roots
+	}
+
+	if hc.CertFile != "" || hc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(hc.CertFile, hc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	pins := map[string]bool{}
+	for _, pin := range hc.Pins {
+		if !strings.HasPrefix(pin, "sha256/") {
+			return nil, fmt.Errorf("pin %q should start with sha256/", pin)
+		}
+		pins[strings.TrimPrefix(pin, "sha256/")] = true
+	}
+
+	if hc.Insecure {
+		config.InsecureSkipVerify = true
+	}
+
+	if len(pins) > 0 {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range pinnable(cs, hc.Insecure) {
+				if pins[Pin(cert)] {
+					return nil
+				}
+			}
+			return fmt.Errorf("no certificate from %s matches a pinned key", cs.ServerName)
+		}
+	}
+
+	return config, nil
+}
+
+// pinnable returns the certificates a pin can match. The server can send any
+// certificates, so only those in a verified chain count, or only the leaf
+// when the chain isn't verified.
+func pinnable(cs tls.ConnectionState, insecure bool) []*x509.Certificate {
+	if insecure {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		return cs.PeerCertificates[:1]
+	}
+
+	certs := []*x509.Certificate{}
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+
+	return certs
+}
+
+// Pin returns the base64 sha256 hash of a certificate's public key
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUpstream(t *testing.T) (*httptest.Server, string) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("llamas"))
+	}))
+
+	file := filepath.Join(t.TempDir(), "ca.crt")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return srv, file
+}
+
+func get(t *testing.T, config *TLS, url string) (string, error) {
+	resp, err := (&http.Client{Transport: config.Transport()}).Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestExtraCABundlesAreTrusted(t *testing.T) {
+	srv, caFile := newUpstream(t)
+	defer srv.Close()
+
+	if _, err := get(t, nil, srv.URL); err == nil {
+		t.Fatal("Expected an untrusted upstream to fail")
+	}
+
+	config, err := NewTLS(map[string]HostConfig{"127.0.0.1": {CAFiles: []string{caFile}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body, err := get(t, config, srv.URL); err != nil || body != "llamas" {
+		t.Fatalf("Expected llamas, got %q (%v)", body, err)
+	}
+}
+
+func TestPinsMustMatch(t *testing.T) {
+	srv, caFile := newUpstream(t)
+	defer srv.Close()
+
+	config, _ := NewTLS(map[string]HostConfig{"127.0.0.1": {
+		CAFiles: []string{caFile},
+		Pins:    []string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+	}})
+
+	if _, err := get(t, config, srv.URL); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Fatalf("Expected a pin mismatch, got %v", err)
+	}
+
+	config, _ = NewTLS(map[string]HostConfig{"127.0.0.1": {
+		Insecure: true,
+		Pins:     []string{"sha256/" + Pin(srv.Certificate())},
+	}})
+
+	if body, err := get(t, config, srv.URL); err != nil || body != "llamas" {
+		t.Fatalf("Expected llamas, got %q (%v)", body, err)
+	}
+}
+
+func TestPinsOnlyMatchTrustedCertificates(t *testing.T) {
+	// a certificate the server doesn't have the key for
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pinned"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, _ := x509.ParseCertificate(der)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("llamas"))
+	}))
+	srv.StartTLS()
+	defer srv.Close()
+
+	// append the pinned certificate to the server's chain
+	cert := srv.TLS.Certificates[0]
+	cert.Certificate = append(cert.Certificate, pinned.Raw)
+	srv.TLS.Certificates = []tls.Certificate{cert}
+
+	file := filepath.Join(t.TempDir(), "ca.crt")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hc := range []HostConfig{
+		{CAFiles: []string{file}, Pins: []string{"sha256/" + Pin(pinned)}},
+		{Insecure: true, Pins: []string{"sha256/" + Pin(pinned)}},
+	} {
+		config, _ := NewTLS(map[string]HostConfig{"127.0.0.1": hc})
+		if _, err := get(t, config, srv.URL); err == nil || !strings.Contains(err.Error(), "pinned") {
+			t.Fatalf("Expected an appended pinned certificate to be rejected, got %v", err)
+		}
+	}
+}
+
+func TestWildcardAppliesToOtherHosts(t *testing.T) {
+	config, err := NewTLS(map[string]HostConfig{"*": {Insecure: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := config.Config("registry.npmjs.org:443"); !c.InsecureSkipVerify || c.ServerName != "registry.npmjs.org" {
+		t.Fatalf("Unexpected config %#v", c)
+	}
+}
+
+func TestLoadRejectsInvalidPins(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "upstream.json")
+	ioutil.WriteFile(file, []byte(`{"example.org":{"pins":["md5/llamas"]}}`), 0644)
+
+	if _, err := LoadTLS(file); err == nil {
+		t.Fatal("Expected an invalid pin to be rejected")
+	}
+}